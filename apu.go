@@ -0,0 +1,805 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"strings"
+)
+
+const (
+	// Sound registers
+	NR10 uint16 = 0xFF10 // Channel 1 sweep
+	NR11 uint16 = 0xFF11 // Channel 1 length timer & duty cycle
+	NR12 uint16 = 0xFF12 // Channel 1 volume & envelope
+	NR13 uint16 = 0xFF13 // Channel 1 period low
+	NR14 uint16 = 0xFF14 // Channel 1 period high & control
+	NR21 uint16 = 0xFF16 // Channel 2 length timer & duty cycle
+	NR22 uint16 = 0xFF17 // Channel 2 volume & envelope
+	NR23 uint16 = 0xFF18 // Channel 2 period low
+	NR24 uint16 = 0xFF19 // Channel 2 period high & control
+	NR30 uint16 = 0xFF1A // Channel 3 DAC enable
+	NR31 uint16 = 0xFF1B // Channel 3 length timer
+	NR32 uint16 = 0xFF1C // Channel 3 output level
+	NR33 uint16 = 0xFF1D // Channel 3 period low
+	NR34 uint16 = 0xFF1E // Channel 3 period high & control
+	NR41 uint16 = 0xFF20 // Channel 4 length timer
+	NR42 uint16 = 0xFF21 // Channel 4 volume & envelope
+	NR43 uint16 = 0xFF22 // Channel 4 frequency & randomness
+	NR44 uint16 = 0xFF23 // Channel 4 control
+	NR50 uint16 = 0xFF24 // Master volume & VIN panning
+	NR51 uint16 = 0xFF25 // Sound panning
+	NR52 uint16 = 0xFF26 // Sound on/off
+
+	WaveRAM    uint16 = 0xFF30
+	WaveRAMEnd uint16 = 0xFF40
+
+	// DefaultSampleRate is the host sample rate used when none is configured
+	DefaultSampleRate = 48000
+
+	// the frame sequencer is clocked at 512Hz
+	frameSequencerCycles = 8192
+
+	// capacitorCharge is how much of its charge the high pass filter
+	// capacitor keeps each cycle
+	capacitorCharge = 0.999958
+)
+
+// apuReadMasks are ORed into the sound registers when they are read, unused
+// and write only bits always read back as 1
+var apuReadMasks = [0x20]byte{
+	0x80, 0x3F, 0x00, 0xFF, 0xBF, // NR10-NR14
+	0xFF, 0x3F, 0x00, 0xFF, 0xBF, // NR20-NR24
+	0x7F, 0xFF, 0x9F, 0xFF, 0xBF, // NR30-NR34
+	0xFF, 0xFF, 0x00, 0x00, 0xBF, // NR40-NR44
+	0x00, 0x00, 0x70, // NR50-NR52
+	0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF,
+}
+
+// dutyPatterns are the waveforms of the pulse channels for each duty cycle
+var dutyPatterns = [4][8]byte{
+	{0, 0, 0, 0, 0, 0, 0, 1}, // 12.5%
+	{1, 0, 0, 0, 0, 0, 0, 1}, // 25%
+	{1, 0, 0, 0, 0, 1, 1, 1}, // 50%
+	{0, 1, 1, 1, 1, 1, 1, 0}, // 75%
+}
+
+// noiseDivisors are the base periods of the noise channel for each divisor code
+var noiseDivisors = [8]int{8, 16, 32, 48, 64, 80, 96, 112}
+
+// Channels is a set of sound channels, bit 0 is channel 1 through to bit 3 for channel 4.
+type Channels byte
+
+// AllChannels has every sound channel set
+const AllChannels Channels = 0xF
+
+func (c Channels) String() string {
+	var s strings.Builder
+	for i := 0; i < 4; i++ {
+		if TestBit(byte(c), i) {
+			fmt.Fprint(&s, i+1)
+		}
+	}
+
+	return s.String()
+}
+
+// Set implements flag.Value, channels are given by number such as "13" or "1,3".
+func (c *Channels) Set(list string) error {
+	var channels Channels
+	for _, r := range list {
+		switch {
+		case r >= '1' && r <= '4':
+			channels |= 1 << (r - '1')
+		case r == ',' || r == ' ':
+		default:
+			return fmt.Errorf("unknown sound channel: %c", r)
+		}
+	}
+
+	*c = channels
+
+	return nil
+}
+
+// APU is the audio processing unit. It runs the four sound channels and mixes
+// them into stereo samples at the host sample rate.
+type APU struct {
+	regs    [0x20]byte
+	waveRAM [0x10]byte
+
+	enabled bool
+
+	ch1 pulseChannel
+	ch2 pulseChannel
+	ch3 waveChannel
+	ch4 noiseChannel
+
+	sequencerCounter int
+	sequencerStep    int
+
+	// samples are produced whenever sampleClock passes ClockSpeed, the
+	// channel output is averaged over the cycles in between
+	sampleRate  int
+	sampleClock int
+	sums        [4][2]float32
+	sumCount    int
+
+	// capacitors hold the charge of the high pass filter on each side of each
+	// channel, it removes the DC offset of DACs which are on but silent.
+	// The filter is linear so filtering the channels before mixing them is
+	// the same as filtering the mix like the hardware does.
+	capacitors [4][2]float32
+	charge     float32
+
+	// heard are the channels which are mixed into the output
+	heard Channels
+
+	recorder  *Recorder
+	recordErr error
+
+	// samples holds the interleaved left and right samples which have not
+	// been taken by the frontend yet
+	samples []float32
+}
+
+func NewAPU(sampleRate int) *APU {
+	a := &APU{heard: AllChannels}
+	a.ch1.length.max = 64
+	a.ch2.length.max = 64
+	a.ch3.length.max = 256
+	a.ch4.length.max = 64
+	a.ch4.lfsr = 0x7FFF
+	a.SetSampleRate(sampleRate)
+
+	return a
+}
+
+// SetSampleRate changes the rate samples are produced at, a rate of 0 uses DefaultSampleRate.
+func (a *APU) SetSampleRate(rate int) {
+	if rate <= 0 {
+		rate = DefaultSampleRate
+	}
+
+	a.sampleRate = rate
+	a.charge = float32(math.Pow(capacitorCharge, float64(ClockSpeed)/float64(rate)))
+}
+
+// SampleRate returns the rate samples are produced at.
+func (a *APU) SampleRate() int {
+	return a.sampleRate
+}
+
+// Samples returns the interleaved stereo samples produced since it was last called.
+func (a *APU) Samples() []float32 {
+	s := a.samples
+	a.samples = nil
+
+	return s
+}
+
+// SkipBoot sets the sound registers to the values the boot rom leaves behind.
+func (a *APU) SkipBoot() {
+	a.Write(NR52, 0xF1)
+
+	regs := []struct {
+		addr uint16
+		val  byte
+	}{
+		{NR10, 0x80}, {NR11, 0xBF}, {NR12, 0xF3}, {NR14, 0xBF},
+		{NR21, 0x3F}, {NR22, 0x00}, {NR24, 0xBF},
+		{NR30, 0x7F}, {NR31, 0xFF}, {NR32, 0x9F}, {NR34, 0xBF},
+		{NR41, 0xFF}, {NR42, 0x00}, {NR43, 0x00}, {NR44, 0xBF},
+		{NR50, 0x77}, {NR51, 0xF3},
+	}
+
+	for _, r := range regs {
+		val := r.val
+
+		// the boot sound has finished so don't trigger the channels again
+		switch r.addr {
+		case NR14, NR24, NR34, NR44:
+			val = ResetBit(val, 7)
+		}
+
+		a.Write(r.addr, val)
+	}
+
+	// channel 1 played the boot sound and is still on, its envelope has faded it out
+	a.ch1.enabled = true
+}
+
+// Update runs the APU for the given number of cycles.
+func (a *APU) Update(cycles int) {
+	for i := 0; i < cycles; i++ {
+		if a.enabled {
+			a.sequencerCounter++
+			if a.sequencerCounter >= frameSequencerCycles {
+				a.sequencerCounter = 0
+				a.clockSequencer()
+			}
+
+			a.ch1.step()
+			a.ch2.step()
+			a.ch3.step()
+			a.ch4.step()
+		}
+
+		channels := a.mix()
+		for ch, out := range channels {
+			a.sums[ch][0] += out[0]
+			a.sums[ch][1] += out[1]
+		}
+		a.sumCount++
+
+		a.sampleClock += a.sampleRate
+		if a.sampleClock >= ClockSpeed {
+			a.sampleClock -= ClockSpeed
+			a.emitSample()
+		}
+	}
+}
+
+// emitSample averages the channel output since the last sample, passes it
+// through the high pass filter and mixes the channels which aren't muted into
+// the next sample.
+func (a *APU) emitSample() {
+	var mixed [2]float32
+	var channels [4][2]float32
+
+	n := float32(a.sumCount)
+	for ch := range a.sums {
+		for side := range channels[ch] {
+			channels[ch][side] = a.highPass(ch, side, a.sums[ch][side]/n)
+		}
+
+		if TestBit(byte(a.heard), ch) {
+			mixed[0] += channels[ch][0]
+			mixed[1] += channels[ch][1]
+		}
+	}
+
+	a.sums = [4][2]float32{}
+	a.sumCount = 0
+
+	if a.recorder != nil {
+		if err := a.recorder.Write(mixed, channels); err != nil {
+			a.recordErr = err
+			a.recorder.Close()
+			a.recorder = nil
+		}
+	}
+
+	// nothing may be taking the samples, so stop once a second is buffered
+	if len(a.samples) < 2*a.sampleRate {
+		a.samples = append(a.samples, mixed[0], mixed[1])
+	}
+}
+
+// highPass filters the output of one side of a channel, the capacitor charges
+// towards the input so a constant level fades to silence.
+func (a *APU) highPass(ch, side int, in float32) float32 {
+	out := in - a.capacitors[ch][side]
+	a.capacitors[ch][side] = in - out*a.charge
+
+	return out
+}
+
+// SetHeard sets which channels are heard, recordings of single channels
+// include their channel either way.
+func (a *APU) SetHeard(channels Channels) {
+	a.heard = channels & AllChannels
+}
+
+// Heard returns the channels which are heard.
+func (a *APU) Heard() Channels {
+	return a.heard
+}
+
+// StartRecording records the output to a WAV file at path, and each channel
+// to its own file if perChannel is set. Any recording in progress is stopped.
+func (a *APU) StartRecording(path string, perChannel bool) error {
+	if err := a.StopRecording(); err != nil {
+		return err
+	}
+
+	r, err := NewRecorder(path, perChannel, a.sampleRate)
+	if err != nil {
+		return err
+	}
+
+	a.recorder = r
+
+	return nil
+}
+
+// StopRecording finishes the recording, returning any error that happened while recording.
+func (a *APU) StopRecording() error {
+	err := a.recordErr
+	a.recordErr = nil
+
+	if a.recorder != nil {
+		if cerr := a.recorder.Close(); err == nil {
+			err = cerr
+		}
+
+		a.recorder = nil
+	}
+
+	return err
+}
+
+// Recording reports whether the output is being recorded.
+func (a *APU) Recording() bool {
+	return a.recorder != nil
+}
+
+// clockSequencer steps the frame sequencer, which clocks the length counters
+// at 256Hz, the sweep at 128Hz and the envelopes at 64Hz.
+func (a *APU) clockSequencer() {
+	switch a.sequencerStep {
+	case 0, 4:
+		a.clockLength()
+	case 2, 6:
+		a.clockLength()
+		a.ch1.clockSweep()
+	case 7:
+		a.ch1.env.clock()
+		a.ch2.env.clock()
+		a.ch4.env.clock()
+	}
+
+	a.sequencerStep = (a.sequencerStep + 1) % 8
+}
+
+func (a *APU) clockLength() {
+	a.ch1.length.clock(&a.ch1.enabled)
+	a.ch2.length.clock(&a.ch2.enabled)
+	a.ch3.length.clock(&a.ch3.enabled)
+	a.ch4.length.clock(&a.ch4.enabled)
+}
+
+// mix returns the left and right output of each channel according to the
+// panning in NR51 and the master volume in NR50.
+func (a *APU) mix() (channels [4][2]float32) {
+	if !a.enabled {
+		return channels
+	}
+
+	outputs := [4]float32{
+		dac(a.ch1.dacEnabled, a.ch1.output()),
+		dac(a.ch2.dacEnabled, a.ch2.output()),
+		dac(a.ch3.dacEnabled, a.ch3.output(&a.waveRAM)),
+		dac(a.ch4.dacEnabled, a.ch4.output()),
+	}
+
+	panning := a.regs[NR51-NR10]
+	volume := a.regs[NR50-NR10]
+	left := float32((volume>>4)&0x7+1) / 32
+	right := float32(volume&0x7+1) / 32
+
+	for i, out := range outputs {
+		if TestBit(panning, i+4) {
+			channels[i][0] = out * left
+		}
+
+		if TestBit(panning, i) {
+			channels[i][1] = out * right
+		}
+	}
+
+	return channels
+}
+
+// dac converts the digital output of a channel, 0 to 15, to an analog level between -1 and 1.
+func dac(enabled bool, sample byte) float32 {
+	if !enabled {
+		return 0
+	}
+
+	return 1 - float32(sample)/7.5
+}
+
+func (a *APU) Read(addr uint16) byte {
+	if addr >= WaveRAM {
+		return a.waveRAM[addr-WaveRAM]
+	}
+
+	reg := addr - NR10
+	if addr == NR52 {
+		val := apuReadMasks[reg]
+		if a.enabled {
+			val = SetBit(val, 7)
+		}
+
+		for i, on := range []bool{a.ch1.enabled, a.ch2.enabled, a.ch3.enabled, a.ch4.enabled} {
+			if on {
+				val = SetBit(val, byte(i))
+			}
+		}
+
+		return val
+	}
+
+	return a.regs[reg] | apuReadMasks[reg]
+}
+
+func (a *APU) Write(addr uint16, val byte) {
+	if addr >= WaveRAM {
+		a.waveRAM[addr-WaveRAM] = val
+		return
+	}
+
+	if addr == NR52 {
+		a.setPower(TestBit(val, 7))
+		return
+	}
+
+	// the registers can't be written while the APU is off
+	if !a.enabled {
+		return
+	}
+
+	a.regs[addr-NR10] = val
+
+	switch addr {
+	case NR10:
+		a.ch1.sweepPeriod = (val >> 4) & 0x7
+		a.ch1.sweepNegate = TestBit(val, 3)
+		a.ch1.sweepShift = val & 0x7
+	case NR11:
+		a.ch1.duty = val >> 6
+		a.ch1.length.load(int(val & 0x3F))
+	case NR12:
+		a.ch1.env.load(val)
+		a.ch1.setDAC(val&0xF8 != 0)
+	case NR13:
+		a.ch1.freq = a.ch1.freq&0x700 | uint16(val)
+	case NR14:
+		a.ch1.freq = a.ch1.freq&0xFF | uint16(val&0x7)<<8
+		a.ch1.length.enabled = TestBit(val, 6)
+		if TestBit(val, 7) {
+			a.ch1.trigger()
+		}
+
+	case NR21:
+		a.ch2.duty = val >> 6
+		a.ch2.length.load(int(val & 0x3F))
+	case NR22:
+		a.ch2.env.load(val)
+		a.ch2.setDAC(val&0xF8 != 0)
+	case NR23:
+		a.ch2.freq = a.ch2.freq&0x700 | uint16(val)
+	case NR24:
+		a.ch2.freq = a.ch2.freq&0xFF | uint16(val&0x7)<<8
+		a.ch2.length.enabled = TestBit(val, 6)
+		if TestBit(val, 7) {
+			a.ch2.trigger()
+		}
+
+	case NR30:
+		a.ch3.dacEnabled = TestBit(val, 7)
+		if !a.ch3.dacEnabled {
+			a.ch3.enabled = false
+		}
+	case NR31:
+		a.ch3.length.load(int(val))
+	case NR32:
+		a.ch3.level = (val >> 5) & 0x3
+	case NR33:
+		a.ch3.freq = a.ch3.freq&0x700 | uint16(val)
+	case NR34:
+		a.ch3.freq = a.ch3.freq&0xFF | uint16(val&0x7)<<8
+		a.ch3.length.enabled = TestBit(val, 6)
+		if TestBit(val, 7) {
+			a.ch3.trigger()
+		}
+
+	case NR41:
+		a.ch4.length.load(int(val & 0x3F))
+	case NR42:
+		a.ch4.env.load(val)
+		a.ch4.dacEnabled = val&0xF8 != 0
+		if !a.ch4.dacEnabled {
+			a.ch4.enabled = false
+		}
+	case NR43:
+		a.ch4.shift = val >> 4
+		a.ch4.narrow = TestBit(val, 3)
+		a.ch4.divisor = val & 0x7
+	case NR44:
+		a.ch4.length.enabled = TestBit(val, 6)
+		if TestBit(val, 7) {
+			a.ch4.trigger()
+		}
+	}
+}
+
+// setPower turns the APU on or off, turning it off clears all of the sound registers.
+func (a *APU) setPower(on bool) {
+	if on == a.enabled {
+		return
+	}
+
+	if !on {
+		for addr := NR10; addr < NR52; addr++ {
+			a.Write(addr, 0)
+		}
+	} else {
+		a.sequencerStep = 0
+		a.sequencerCounter = 0
+	}
+
+	a.enabled = on
+}
+
+// lengthCounter turns a channel off once it has played for its length.
+type lengthCounter struct {
+	enabled bool
+	counter int
+	max     int
+}
+
+// load sets the length from the length timer bits of a register.
+func (l *lengthCounter) load(val int) {
+	l.counter = l.max - val
+}
+
+func (l *lengthCounter) clock(channelEnabled *bool) {
+	if !l.enabled || l.counter == 0 {
+		return
+	}
+
+	l.counter--
+	if l.counter == 0 {
+		*channelEnabled = false
+	}
+}
+
+func (l *lengthCounter) trigger() {
+	if l.counter == 0 {
+		l.counter = l.max
+	}
+}
+
+// envelope changes the volume of a channel over time.
+type envelope struct {
+	initial  byte
+	increase bool
+	period   byte
+
+	volume byte
+	timer  byte
+}
+
+func (e *envelope) load(val byte) {
+	e.initial = val >> 4
+	e.increase = TestBit(val, 3)
+	e.period = val & 0x7
+}
+
+func (e *envelope) trigger() {
+	e.volume = e.initial
+	e.timer = e.period
+}
+
+func (e *envelope) clock() {
+	if e.period == 0 {
+		return
+	}
+
+	if e.timer > 0 {
+		e.timer--
+	}
+
+	if e.timer > 0 {
+		return
+	}
+
+	e.timer = e.period
+	if e.increase && e.volume < 15 {
+		e.volume++
+	} else if !e.increase && e.volume > 0 {
+		e.volume--
+	}
+}
+
+// pulseChannel is a square wave channel, channel 1 also has a frequency sweep.
+type pulseChannel struct {
+	enabled    bool
+	dacEnabled bool
+
+	duty     byte
+	dutyStep int
+	freq     uint16
+	timer    int
+
+	length lengthCounter
+	env    envelope
+
+	sweepPeriod  byte
+	sweepNegate  bool
+	sweepShift   byte
+	sweepTimer   byte
+	sweepShadow  uint16
+	sweepEnabled bool
+}
+
+func (c *pulseChannel) setDAC(on bool) {
+	c.dacEnabled = on
+	if !on {
+		c.enabled = false
+	}
+}
+
+func (c *pulseChannel) trigger() {
+	c.enabled = c.dacEnabled
+	c.timer = (2048 - int(c.freq)) * 4
+	c.length.trigger()
+	c.env.trigger()
+
+	c.sweepShadow = c.freq
+	c.sweepTimer = c.sweepPeriod
+	if c.sweepTimer == 0 {
+		c.sweepTimer = 8
+	}
+
+	c.sweepEnabled = c.sweepPeriod != 0 || c.sweepShift != 0
+	if c.sweepShift != 0 {
+		c.sweepFrequency()
+	}
+}
+
+func (c *pulseChannel) step() {
+	c.timer--
+	if c.timer <= 0 {
+		c.timer = (2048 - int(c.freq)) * 4
+		c.dutyStep = (c.dutyStep + 1) % 8
+	}
+}
+
+func (c *pulseChannel) clockSweep() {
+	if c.sweepTimer > 0 {
+		c.sweepTimer--
+	}
+
+	if c.sweepTimer > 0 {
+		return
+	}
+
+	c.sweepTimer = c.sweepPeriod
+	if c.sweepTimer == 0 {
+		c.sweepTimer = 8
+	}
+
+	if !c.sweepEnabled || c.sweepPeriod == 0 {
+		return
+	}
+
+	freq := c.sweepFrequency()
+	if freq <= 2047 && c.sweepShift != 0 {
+		c.sweepShadow = freq
+		c.freq = freq
+
+		// the new frequency is checked for overflow again straight away
+		c.sweepFrequency()
+	}
+}
+
+// sweepFrequency calculates the next frequency of the sweep, turning the
+// channel off if it overflows.
+func (c *pulseChannel) sweepFrequency() uint16 {
+	delta := c.sweepShadow >> c.sweepShift
+
+	freq := c.sweepShadow + delta
+	if c.sweepNegate {
+		freq = c.sweepShadow - delta
+	}
+
+	if freq > 2047 {
+		c.enabled = false
+	}
+
+	return freq
+}
+
+func (c *pulseChannel) output() byte {
+	if !c.enabled {
+		return 0
+	}
+
+	return dutyPatterns[c.duty][c.dutyStep] * c.env.volume
+}
+
+// waveChannel plays back the 32 4-bit samples in wave RAM.
+type waveChannel struct {
+	enabled    bool
+	dacEnabled bool
+
+	level    byte
+	freq     uint16
+	timer    int
+	position int
+
+	length lengthCounter
+}
+
+func (c *waveChannel) trigger() {
+	c.enabled = c.dacEnabled
+	c.timer = (2048 - int(c.freq)) * 2
+	c.position = 0
+	c.length.trigger()
+}
+
+func (c *waveChannel) step() {
+	c.timer--
+	if c.timer <= 0 {
+		c.timer = (2048 - int(c.freq)) * 2
+		c.position = (c.position + 1) % 32
+	}
+}
+
+func (c *waveChannel) output(wave *[0x10]byte) byte {
+	if !c.enabled || c.level == 0 {
+		return 0
+	}
+
+	// the first sample is in the high nibble
+	sample := wave[c.position/2]
+	if c.position%2 == 0 {
+		sample >>= 4
+	}
+
+	return (sample & 0xF) >> (c.level - 1)
+}
+
+// noiseChannel outputs pseudo random noise from a linear feedback shift register.
+type noiseChannel struct {
+	enabled    bool
+	dacEnabled bool
+
+	shift   byte
+	narrow  bool
+	divisor byte
+	timer   int
+	lfsr    uint16
+
+	length lengthCounter
+	env    envelope
+}
+
+func (c *noiseChannel) period() int {
+	return noiseDivisors[c.divisor] << c.shift
+}
+
+func (c *noiseChannel) trigger() {
+	c.enabled = c.dacEnabled
+	c.timer = c.period()
+	c.lfsr = 0x7FFF
+	c.length.trigger()
+	c.env.trigger()
+}
+
+func (c *noiseChannel) step() {
+	c.timer--
+	if c.timer > 0 {
+		return
+	}
+
+	c.timer = c.period()
+
+	bit := (c.lfsr ^ (c.lfsr >> 1)) & 0x1
+	c.lfsr = (c.lfsr >> 1) | bit<<14
+
+	// in 7 bit mode the result is also put into bit 6
+	if c.narrow {
+		c.lfsr = c.lfsr&^(1<<6) | bit<<6
+	}
+}
+
+func (c *noiseChannel) output() byte {
+	if !c.enabled || c.lfsr&0x1 == 1 {
+		return 0
+	}
+
+	return c.env.volume
+}
@@ -0,0 +1,308 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+// newTestAPU returns an APU which is switched on.
+func newTestAPU() *APU {
+	a := NewAPU(DefaultSampleRate)
+	a.Write(NR52, 0x80)
+
+	return a
+}
+
+func TestAPUReadMasks(t *testing.T) {
+	tests := []struct {
+		addr  uint16
+		write byte
+		want  byte
+	}{
+		{NR10, 0x00, 0x80},
+		{NR10, 0x7F, 0xFF},
+		{NR11, 0x00, 0x3F},
+		{NR11, 0xC0, 0xFF},
+		{NR12, 0x00, 0x00},
+		{NR12, 0xF3, 0xF3},
+		{NR13, 0x12, 0xFF},
+		{NR14, 0x00, 0xBF},
+		{NR14, 0x40, 0xFF},
+		{0xFF15, 0x00, 0xFF},
+		{NR21, 0x80, 0xBF},
+		{NR23, 0x00, 0xFF},
+		{NR24, 0x07, 0xBF},
+		{NR30, 0x00, 0x7F},
+		{NR30, 0x80, 0xFF},
+		{NR31, 0x00, 0xFF},
+		{NR32, 0x00, 0x9F},
+		{NR32, 0x60, 0xFF},
+		{NR33, 0x00, 0xFF},
+		{NR34, 0x00, 0xBF},
+		{0xFF1F, 0x00, 0xFF},
+		{NR41, 0x00, 0xFF},
+		{NR42, 0x00, 0x00},
+		{NR43, 0x5A, 0x5A},
+		{NR44, 0x00, 0xBF},
+		{NR50, 0x77, 0x77},
+		{NR51, 0xF3, 0xF3},
+		{0xFF27, 0x00, 0xFF},
+	}
+
+	for _, tt := range tests {
+		a := newTestAPU()
+		a.Write(tt.addr, tt.write)
+
+		if got := a.Read(tt.addr); got != tt.want {
+			t.Errorf("writing %#02x to %#04x reads back %#02x, want %#02x", tt.write, tt.addr, got, tt.want)
+		}
+	}
+
+	// NR52 only has the power and channel bits
+	if got := newTestAPU().Read(NR52); got != 0xF0 {
+		t.Errorf("NR52 reads %#02x with every channel off, want 0xf0", got)
+	}
+}
+
+func TestLengthCounter(t *testing.T) {
+	tests := []struct {
+		name    string
+		max     int
+		load    int
+		enabled bool
+		clocks  int
+		want    bool
+	}{
+		{name: "not expired", max: 64, load: 60, enabled: true, clocks: 3, want: true},
+		{name: "expired", max: 64, load: 60, enabled: true, clocks: 4, want: false},
+		{name: "disabled", max: 64, load: 63, enabled: false, clocks: 10, want: true},
+		{name: "wave length", max: 256, load: 0, enabled: true, clocks: 255, want: true},
+		{name: "wave expired", max: 256, load: 0, enabled: true, clocks: 256, want: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			l := lengthCounter{max: tt.max, enabled: tt.enabled}
+			l.load(tt.load)
+
+			on := true
+			for i := 0; i < tt.clocks; i++ {
+				l.clock(&on)
+			}
+
+			if on != tt.want {
+				t.Errorf("channel on is %t after %d clocks, want %t", on, tt.clocks, tt.want)
+			}
+		})
+	}
+
+	// triggering an expired counter reloads it with the full length
+	l := lengthCounter{max: 64}
+	l.trigger()
+	if l.counter != 64 {
+		t.Errorf("counter is %d after trigger, want 64", l.counter)
+	}
+}
+
+func TestEnvelope(t *testing.T) {
+	tests := []struct {
+		name   string
+		reg    byte
+		clocks int
+		want   byte
+	}{
+		{name: "period 0 holds", reg: 0xF0, clocks: 10, want: 15},
+		{name: "decrease", reg: 0xF1, clocks: 3, want: 12},
+		{name: "decrease period 2", reg: 0xF2, clocks: 4, want: 13},
+		{name: "stops at 0", reg: 0x21, clocks: 5, want: 0},
+		{name: "increase", reg: 0x09, clocks: 3, want: 3},
+		{name: "stops at 15", reg: 0xE9, clocks: 5, want: 15},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var e envelope
+			e.load(tt.reg)
+			e.trigger()
+
+			for i := 0; i < tt.clocks; i++ {
+				e.clock()
+			}
+
+			if e.volume != tt.want {
+				t.Errorf("volume is %d after %d clocks, want %d", e.volume, tt.clocks, tt.want)
+			}
+		})
+	}
+}
+
+func TestSweep(t *testing.T) {
+	tests := []struct {
+		name   string
+		nr10   byte
+		freq   uint16
+		clocks int
+
+		wantFreq uint16
+		wantOn   bool
+	}{
+		{name: "up", nr10: 0x12, freq: 0x400, clocks: 1, wantFreq: 0x500, wantOn: true},
+		{name: "down", nr10: 0x19, freq: 0x400, clocks: 2, wantFreq: 0x100, wantOn: true},
+		{name: "period 2", nr10: 0x22, freq: 0x400, clocks: 1, wantFreq: 0x400, wantOn: true},
+		{name: "shift 0 doesn't change", nr10: 0x10, freq: 0x200, clocks: 4, wantFreq: 0x200, wantOn: true},
+		// the check straight after the update sees 0x600 + 0x300 overflow
+		{name: "overflow after update", nr10: 0x11, freq: 0x400, clocks: 1, wantFreq: 0x600, wantOn: false},
+		// the check on trigger already overflows
+		{name: "overflow on trigger", nr10: 0x11, freq: 0x700, clocks: 0, wantFreq: 0x700, wantOn: false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAPU()
+			a.Write(NR10, tt.nr10)
+			a.Write(NR12, 0xF0)
+			a.Write(NR13, byte(tt.freq))
+			a.Write(NR14, 0x80|byte(tt.freq>>8))
+
+			for i := 0; i < tt.clocks; i++ {
+				a.ch1.clockSweep()
+			}
+
+			if a.ch1.freq != tt.wantFreq {
+				t.Errorf("frequency is %#03x, want %#03x", a.ch1.freq, tt.wantFreq)
+			}
+
+			if on := TestBit(a.Read(NR52), 0); on != tt.wantOn {
+				t.Errorf("channel 1 on is %t, want %t", on, tt.wantOn)
+			}
+		})
+	}
+}
+
+func TestLFSR(t *testing.T) {
+	tests := []struct {
+		name   string
+		narrow bool
+		period int
+	}{
+		{name: "15 bit", narrow: false, period: 0x7FFF},
+		{name: "7 bit", narrow: true, period: 0x7F},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := noiseChannel{narrow: tt.narrow, lfsr: 0x7FFF}
+
+			// the register is shifted every time the timer runs out
+			bits := make([]uint16, 3*tt.period)
+			for i := range bits {
+				c.timer = 1
+				c.step()
+				bits[i] = c.lfsr & 0x1
+			}
+
+			// skip the first period while the 7 bit mode settles into its loop
+			for i := tt.period; i < 2*tt.period; i++ {
+				if bits[i] != bits[i+tt.period] {
+					t.Fatalf("output %d differs from one period later", i)
+				}
+			}
+
+			// the 15 bit sequence must not repeat as often as the 7 bit one
+			if !tt.narrow {
+				for i := tt.period; i < tt.period+0x7F; i++ {
+					if bits[i] != bits[i+0x7F] {
+						return
+					}
+				}
+
+				t.Error("15 bit mode repeats every 127 shifts")
+			}
+		})
+	}
+}
+
+func TestDACOff(t *testing.T) {
+	tests := []struct {
+		name    string
+		channel int
+		dac     uint16
+		dacOn   byte
+		trigger uint16
+	}{
+		{name: "channel 1", channel: 0, dac: NR12, dacOn: 0xF0, trigger: NR14},
+		{name: "channel 2", channel: 1, dac: NR22, dacOn: 0x08, trigger: NR24},
+		{name: "channel 3", channel: 2, dac: NR30, dacOn: 0x80, trigger: NR34},
+		{name: "channel 4", channel: 3, dac: NR42, dacOn: 0xF0, trigger: NR44},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := newTestAPU()
+			a.Write(tt.dac, tt.dacOn)
+			a.Write(tt.trigger, 0x80)
+
+			if !TestBit(a.Read(NR52), tt.channel) {
+				t.Fatal("channel is off after trigger")
+			}
+
+			a.Write(tt.dac, 0x00)
+			if TestBit(a.Read(NR52), tt.channel) {
+				t.Error("channel is on after its DAC is switched off")
+			}
+
+			// triggering doesn't turn it back on while the DAC is off
+			a.Write(tt.trigger, 0x80)
+			if TestBit(a.Read(NR52), tt.channel) {
+				t.Error("channel is on after trigger with its DAC off")
+			}
+		})
+	}
+}
+
+func TestAPUSkipBoot(t *testing.T) {
+	a := NewAPU(DefaultSampleRate)
+	a.SkipBoot()
+
+	// only the trigger bits are cleared so the rest of the values stay as
+	// the boot rom left them
+	tests := []struct {
+		addr uint16
+		want byte
+	}{
+		{NR11, 0xBF},
+		{NR12, 0xF3},
+		{NR50, 0x77},
+		{NR51, 0xF3},
+		{NR52, 0xF1},
+	}
+
+	for _, tt := range tests {
+		if got := a.Read(tt.addr); got != tt.want {
+			t.Errorf("%#04x reads %#02x after SkipBoot, want %#02x", tt.addr, got, tt.want)
+		}
+	}
+}
+
+func TestHighPassFilter(t *testing.T) {
+	a := newTestAPU()
+	a.Write(NR50, 0x77)
+	a.Write(NR51, 0xFF)
+
+	// the DAC is on but the channel isn't triggered, so it outputs a constant level
+	a.Write(NR12, 0xF0)
+	a.Update(ClockSpeed / 4)
+
+	samples := a.Samples()
+	if len(samples) == 0 {
+		t.Fatal("no samples")
+	}
+
+	if first := samples[0]; math.Abs(float64(first)) < 0.1 {
+		t.Errorf("first sample is %f, want the DC offset", first)
+	}
+
+	if last := samples[len(samples)-1]; math.Abs(float64(last)) > 0.001 {
+		t.Errorf("last sample is %f, want the DC offset removed", last)
+	}
+}
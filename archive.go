@@ -0,0 +1,104 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+)
+
+// maxROMSize is the size of the largest cartridge rom, anything bigger coming
+// out of an archive is not a rom
+const maxROMSize = 8 * 1024 * 1024
+
+var (
+	zipMagic = []byte("PK\x03\x04")
+	// emptyZipMagic starts a zip archive with no files, which is only its
+	// end of central directory record
+	emptyZipMagic = []byte("PK\x05\x06")
+	gzipMagic     = []byte{0x1F, 0x8B}
+)
+
+// readROM reads the rom at path. Zip and gzip archives are detected by their
+// magic number and the rom is extracted from them. For zip archives entry
+// names the file to load, when it is empty the first .gb or .gbc file is used.
+func readROM(path, entry string) ([]byte, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch {
+	case bytes.HasPrefix(data, zipMagic), bytes.HasPrefix(data, emptyZipMagic):
+		return readZip(data, entry)
+	case bytes.HasPrefix(data, gzipMagic):
+		r, err := gzip.NewReader(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+
+		defer r.Close()
+
+		return readLimited(r)
+	default:
+		return data, nil
+	}
+}
+
+func readZip(data []byte, entry string) ([]byte, error) {
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	for _, f := range zr.File {
+		if !matchEntry(f.Name, entry) {
+			continue
+		}
+
+		r, err := f.Open()
+		if err != nil {
+			return nil, err
+		}
+
+		defer r.Close()
+
+		return readLimited(r)
+	}
+
+	if entry != "" {
+		return nil, fmt.Errorf("no entry named %s in zip archive", entry)
+	}
+
+	return nil, fmt.Errorf("no .gb or .gbc file in zip archive")
+}
+
+// matchEntry reports whether the zip file name is the entry asked for, or
+// when no entry was given whether it is a Gameboy rom.
+func matchEntry(name, entry string) bool {
+	if entry != "" {
+		return name == entry || path.Base(name) == entry
+	}
+
+	ext := strings.ToLower(path.Ext(name))
+
+	return ext == ".gb" || ext == ".gbc"
+}
+
+// readLimited reads a decompressed rom, stopping if it is too big to be one.
+func readLimited(r io.Reader) ([]byte, error) {
+	data, err := io.ReadAll(io.LimitReader(r, maxROMSize+1))
+	if err != nil {
+		return nil, err
+	}
+
+	if len(data) > maxROMSize {
+		return nil, fmt.Errorf("archived rom is larger than %d bytes", maxROMSize)
+	}
+
+	return data, nil
+}
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+type zipEntry struct {
+	name string
+	data []byte
+}
+
+func zipArchive(t *testing.T, entries ...zipEntry) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := zip.NewWriter(&buf)
+
+	for _, e := range entries {
+		f, err := w.Create(e.name)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, err := f.Write(e.data); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func gzipArchive(t *testing.T, data []byte) []byte {
+	t.Helper()
+
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+
+	if _, err := w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	return buf.Bytes()
+}
+
+func TestReadROM(t *testing.T) {
+	rom := []byte("rom")
+	big := make([]byte, maxROMSize+1)
+
+	tests := []struct {
+		name    string
+		file    string
+		data    []byte
+		entry   string
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name: "plain rom",
+			file: "game.gb",
+			data: rom,
+			want: rom,
+		},
+		{
+			name: "zip skips files which aren't roms",
+			file: "game.zip",
+			data: zipArchive(t, zipEntry{"readme.txt", []byte("readme")}, zipEntry{"game.gb", rom}),
+			want: rom,
+		},
+		{
+			name: "zip extension is case insensitive",
+			file: "game.zip",
+			data: zipArchive(t, zipEntry{"info.nfo", nil}, zipEntry{"dir/GAME.GBC", rom}),
+			want: rom,
+		},
+		{
+			name: "zip first rom",
+			file: "game.zip",
+			data: zipArchive(t, zipEntry{"a.gb", rom}, zipEntry{"b.gb", []byte("other")}),
+			want: rom,
+		},
+		{
+			name:  "zip named entry",
+			file:  "game.zip",
+			data:  zipArchive(t, zipEntry{"a.gb", []byte("other")}, zipEntry{"dir/b.bin", rom}),
+			entry: "b.bin",
+			want:  rom,
+		},
+		{
+			name:    "zip missing entry",
+			file:    "game.zip",
+			data:    zipArchive(t, zipEntry{"a.gb", rom}),
+			entry:   "b.gb",
+			wantErr: true,
+		},
+		{
+			name:    "zip without a rom",
+			file:    "game.zip",
+			data:    zipArchive(t, zipEntry{"readme.txt", []byte("readme")}),
+			wantErr: true,
+		},
+		{
+			name:    "empty zip",
+			file:    "game.zip",
+			data:    zipArchive(t),
+			wantErr: true,
+		},
+		{
+			name:    "truncated zip",
+			file:    "game.zip",
+			data:    zipArchive(t, zipEntry{"game.gb", rom})[:20],
+			wantErr: true,
+		},
+		{
+			name:    "zip rom too big",
+			file:    "game.zip",
+			data:    zipArchive(t, zipEntry{"game.gb", big}),
+			wantErr: true,
+		},
+		{
+			name: "gzip",
+			file: "game.gb.gz",
+			data: gzipArchive(t, rom),
+			want: rom,
+		},
+		// archives are found by their magic number, not their extension
+		{
+			name: "gzip with rom extension",
+			file: "game.gb",
+			data: gzipArchive(t, rom),
+			want: rom,
+		},
+		{
+			name: "zip with rom extension",
+			file: "game.gb",
+			data: zipArchive(t, zipEntry{"game.gb", rom}),
+			want: rom,
+		},
+		{
+			name: "rom with gzip extension",
+			file: "game.gz",
+			data: rom,
+			want: rom,
+		},
+		{
+			name:    "truncated gzip",
+			file:    "game.gb.gz",
+			data:    gzipArchive(t, rom)[:5],
+			wantErr: true,
+		},
+		{
+			name:    "gzip rom too big",
+			file:    "game.gb.gz",
+			data:    gzipArchive(t, big),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), tt.file)
+			if err := os.WriteFile(path, tt.data, 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			got, err := readROM(path, tt.entry)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("readROM() error = %v, wantErr %t", err, tt.wantErr)
+			}
+
+			if !tt.wantErr && !bytes.Equal(got, tt.want) {
+				t.Errorf("readROM() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSavePath(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+	}{
+		{"game.gb", "game.sav"},
+		{"roms/game.zip", "roms/game.sav"},
+		{"game.gb.gz", "game.gb.sav"},
+		{"roms.v2/game", "roms.v2/game.sav"},
+	}
+
+	for _, tt := range tests {
+		if got := savePath(tt.path); got != tt.want {
+			t.Errorf("savePath(%q) = %q, want %q", tt.path, got, tt.want)
+		}
+	}
+}
+
+func TestLoadROMArchiveSave(t *testing.T) {
+	// a 32KB MBC1 rom with 8KB of battery backed ram
+	rom := make([]byte, 0x8000)
+	rom[0x147] = 0x03
+	rom[0x149] = 0x02
+
+	var sum byte
+	for _, v := range rom[0x134:0x14D] {
+		sum = sum - v - 1
+	}
+
+	rom[0x14D] = sum
+
+	dir := t.TempDir()
+	path := filepath.Join(dir, "game.zip")
+	if err := os.WriteFile(path, zipArchive(t, zipEntry{"game.gb", rom}), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	// the save sits next to the archive rather than being named after the entry
+	save := make([]byte, 0x2000)
+	save[0] = 0x42
+	if err := os.WriteFile(filepath.Join(dir, "game.sav"), save, 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	m := NewMemory(ModelDMG)
+	if err := m.LoadROM(path, Options{}); err != nil {
+		t.Fatal(err)
+	}
+
+	m.Write(0x0000, 0x0A)
+	if got := m.Read(0xA000); got != 0x42 {
+		t.Errorf("cartridge ram reads %#02x, want 0x42 from game.sav", got)
+	}
+}
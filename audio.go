@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/hajimehoshi/ebiten/v2/audio"
+)
+
+const (
+	// audioLatency is how much audio is kept queued ahead of the player, the
+	// rate control keeps the queue close to this
+	audioLatency = 60 * time.Millisecond
+	// maxRateDelta is the largest change made to the resample ratio, small
+	// enough that the change in pitch can't be heard
+	maxRateDelta = 0.005
+)
+
+// AudioStream resamples the emulator audio and feeds it to an ebiten audio player.
+//
+// The emulator and the sound card run from different clocks so the audio would
+// slowly underrun or build up. To stop that the resample ratio is nudged up
+// when the queue is below audioLatency and down when it is above.
+type AudioStream struct {
+	player *audio.Player
+
+	mu     sync.Mutex
+	queue  []float32
+	target int
+
+	// pos is how far the resampler is between prev and the next input sample
+	pos  float64
+	prev [2]float32
+	last [2]float32
+}
+
+func NewAudioStream(sampleRate int) (*AudioStream, error) {
+	s := &AudioStream{
+		target: int(audioLatency.Seconds() * float64(sampleRate)),
+	}
+
+	ctx := audio.NewContext(sampleRate)
+	p, err := ctx.NewPlayer(s)
+	if err != nil {
+		return nil, err
+	}
+
+	p.SetBufferSize(audioLatency)
+	p.Play()
+	s.player = p
+
+	return s, nil
+}
+
+// Push queues the interleaved stereo samples from the emulator.
+func (s *AudioStream) Push(samples []float32) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	// fill is -1 when the queue is empty and 1 when it has twice the target queued
+	fill := float64(len(s.queue)/2-s.target) / float64(s.target)
+	fill = math.Max(-1, math.Min(1, fill))
+
+	// output more samples for each input sample when the queue is low
+	step := 1 / (1 - maxRateDelta*fill)
+
+	pos := s.pos
+	for i := 0; i < len(samples)/2; i++ {
+		next := [2]float32{samples[i*2], samples[i*2+1]}
+
+		for ; pos < 1; pos += step {
+			f := float32(pos)
+			s.queue = append(s.queue,
+				s.prev[0]+(next[0]-s.prev[0])*f,
+				s.prev[1]+(next[1]-s.prev[1])*f,
+			)
+		}
+
+		pos--
+		s.prev = next
+	}
+
+	s.pos = pos
+
+	// drop audio if the player has stopped reading so the queue can't grow forever
+	if len(s.queue) > 8*s.target {
+		s.queue = s.queue[len(s.queue)-2*s.target:]
+	}
+}
+
+// Read implements io.Reader for the player, giving it 16 bit little endian stereo samples.
+func (s *AudioStream) Read(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	n := len(p) / 4
+	for i := 0; i < n; i++ {
+		// on an underrun hold the last sample rather than clicking to silence
+		if len(s.queue) >= 2 {
+			s.last = [2]float32{s.queue[0], s.queue[1]}
+			s.queue = s.queue[2:]
+		}
+
+		binary.LittleEndian.PutUint16(p[i*4:], uint16(toPCM16(s.last[0])))
+		binary.LittleEndian.PutUint16(p[i*4+2:], uint16(toPCM16(s.last[1])))
+	}
+
+	return n * 4, nil
+}
+
+// Close stops the player.
+func (s *AudioStream) Close() error {
+	return s.player.Close()
+}
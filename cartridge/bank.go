@@ -0,0 +1,57 @@
+package cartridge
+
+// readBank returns the byte at offset in the given bank of mem. Bank numbers
+// past the end of mem wrap around, as the upper bank lines of a small rom or
+// ram are not connected, and reading memory which does not exist returns 0xFF.
+func readBank(mem []byte, bank, bankSize int, offset uint16) byte {
+	if len(mem) == 0 {
+		return 0xFF
+	}
+
+	return mem[bankIndex(bank, bankSize, offset, len(mem))]
+}
+
+// writeBank sets the byte at offset in the given bank of mem, wrapping the
+// same way as readBank. Writes to memory which does not exist are dropped and
+// it reports whether the byte was stored.
+func writeBank(mem []byte, bank, bankSize int, offset uint16, value byte) bool {
+	if len(mem) == 0 {
+		return false
+	}
+
+	mem[bankIndex(bank, bankSize, offset, len(mem))] = value
+
+	return true
+}
+
+// bankIndex returns the index of offset in the given bank of a memory of size n.
+// Memories smaller than a bank are mirrored across it.
+func bankIndex(bank, bankSize int, offset uint16, n int) int {
+	banks := max(n/bankSize, 1)
+	bank %= banks
+	if bank < 0 {
+		bank += banks
+	}
+
+	return (bank*bankSize + int(offset)) % n
+}
+
+// dirtyFlag is embedded by bank controllers with battery backed state. They
+// set it when a byte of their ram, clock, flash or eeprom is stored, so writes
+// which are dropped or go to a port don't cause a save.
+type dirtyFlag struct {
+	dirty bool
+}
+
+// setDirty records that the saved state has changed if changed is true.
+func (d *dirtyFlag) setDirty(changed bool) {
+	d.dirty = d.dirty || changed
+}
+
+// Dirty reports whether the saved state has changed since it was last called.
+func (d *dirtyFlag) Dirty() bool {
+	dirty := d.dirty
+	d.dirty = false
+
+	return dirty
+}
@@ -0,0 +1,200 @@
+package cartridge
+
+import "testing"
+
+// fuzzROMBanks is how many 16KB banks the roms used by the fuzz test have
+const fuzzROMBanks = 8
+
+// testROM returns a rom of the given number of banks with a valid header for
+// cartType. Each byte is its bank number so banking mistakes are easy to spot.
+func testROM(banks int, cartType byte) []byte {
+	rom := make([]byte, banks*romBankSize)
+	for i := range rom {
+		rom[i] = byte(i / romBankSize)
+	}
+
+	writeTestHeader(rom, cartType)
+
+	return rom
+}
+
+func writeTestHeader(header []byte, cartType byte) {
+	for i := logoStart; i < logoEnd; i++ {
+		header[i] = byte(i)
+	}
+
+	header[cartTypeAddr] = cartType
+	header[romSizeAddr] = 0x00
+	header[ramSizeAddr] = 0x00
+	header[headerChecksumAddr] = headerChecksum(header)
+}
+
+// multicartROM returns a 1MB MBC1M rom with a second game header at bank 0x10.
+func multicartROM() []byte {
+	rom := testROM(mbc1MulticartSize/romBankSize, 0x01)
+	copy(rom[mbc1MulticartGameSize:], rom[:logoEnd])
+
+	return rom
+}
+
+// mmm01ROM returns a rom with an MMM01 menu in its last 32KB.
+func mmm01ROM() []byte {
+	rom := testROM(fuzzROMBanks, 0x01)
+	writeTestHeader(rom[len(rom)-mmm01MenuSize:], 0x0B)
+
+	return rom
+}
+
+// bankControllerCase builds a bank controller for the fuzz test. ramClosed
+// reports whether reads from 0xA000-0xBFFF must return 0xFF, because the ram
+// is disabled or because it is mapped there but does not exist.
+type bankControllerCase struct {
+	name      string
+	new       func() BankController
+	ramClosed func(b BankController) bool
+}
+
+func bankControllerCases() []bankControllerCase {
+	rom := testROM(fuzzROMBanks, 0x01)
+	multicart := multicartROM()
+	mmm01 := mmm01ROM()
+
+	return []bankControllerCase{
+		{
+			name:      "ROM",
+			new:       func() BankController { return NewROM(rom) },
+			ramClosed: func(b BankController) bool { return true },
+		},
+		{
+			name:      "MBC1",
+			new:       func() BankController { return NewMBC1(rom, 4*ramBankSize) },
+			ramClosed: func(b BankController) bool { return !b.(*MBC1).ramEnabled },
+		},
+		{
+			name:      "MBC1 without ram",
+			new:       func() BankController { return NewMBC1(rom, 0) },
+			ramClosed: func(b BankController) bool { return true },
+		},
+		{
+			name:      "MBC1M",
+			new:       func() BankController { return NewMBC1(multicart, ramBankSize) },
+			ramClosed: func(b BankController) bool { return !b.(*MBC1).ramEnabled },
+		},
+		{
+			name:      "MBC2",
+			new:       func() BankController { return NewMBC2(rom) },
+			ramClosed: func(b BankController) bool { return !b.(*MBC2).ramEnabled },
+		},
+		{
+			name: "MBC3",
+			new:  func() BankController { return NewMBC3(rom, 4*ramBankSize, false, ClockHost) },
+			ramClosed: func(b BankController) bool {
+				m := b.(*MBC3)
+				// there is no clock to map in place of the ram
+				return !m.ramEnabled || m.ramBank >= rtcSeconds
+			},
+		},
+		{
+			name: "MBC3 with RTC",
+			new:  func() BankController { return NewMBC3(rom, 0, true, ClockEmulated) },
+			ramClosed: func(b BankController) bool {
+				m := b.(*MBC3)
+				return !m.ramEnabled || m.ramBank < rtcSeconds
+			},
+		},
+		{
+			name:      "MBC5",
+			new:       func() BankController { return NewMBC5(rom, 16*ramBankSize, false) },
+			ramClosed: func(b BankController) bool { return !b.(*MBC5).ramEnabled },
+		},
+		{
+			name:      "MBC5 with rumble",
+			new:       func() BankController { return NewMBC5(rom, 0, true) },
+			ramClosed: func(b BankController) bool { return true },
+		},
+		{
+			name:      "MBC6",
+			new:       func() BankController { return NewMBC6(rom, 4*ramBankSize) },
+			ramClosed: func(b BankController) bool { return !b.(*MBC6).ramEnabled },
+		},
+		{
+			name: "MBC7",
+			new:  func() BankController { return NewMBC7(rom) },
+			ramClosed: func(b BankController) bool {
+				m := b.(*MBC7)
+				return !m.ramEnabled1 || !m.ramEnabled2
+			},
+		},
+		{
+			name:      "MMM01",
+			new:       func() BankController { return NewMMM01(mmm01, 4*ramBankSize) },
+			ramClosed: func(b BankController) bool { return !b.(*MMM01).ramEnabled },
+		},
+		{
+			name:      "HuC1",
+			new:       func() BankController { return NewHuC1(rom, 0) },
+			ramClosed: func(b BankController) bool { return !b.(*HuC1).irMode },
+		},
+		{
+			name: "HuC3",
+			new:  func() BankController { return NewHuC3(rom, 0, ClockEmulated) },
+			ramClosed: func(b BankController) bool {
+				mode := b.(*HuC3).mode
+				return mode == huc3ModeRAMRead || mode == huc3ModeRAMWrite
+			},
+		},
+	}
+}
+
+// FuzzBankControllers drives every bank controller with random sequences of
+// register writes, ram writes and reads. Each operation is 4 bytes of the
+// input: the kind of operation, the address and the value written.
+func FuzzBankControllers(f *testing.F) {
+	// enable the ram, write to it and read it back
+	f.Add([]byte{0, 0x00, 0x00, 0x0A, 1, 0x00, 0x10, 0x42, 2, 0xA0, 0x10, 0x00})
+	// select large rom and ram banks then read from them
+	f.Add([]byte{0, 0x20, 0x00, 0xFF, 0, 0x30, 0x00, 0xFF, 0, 0x40, 0x00, 0xFF, 2, 0x40, 0x00, 0x00, 2, 0xB0, 0x00, 0x00})
+	// map the MBC6 flash and send it the program command
+	f.Add([]byte{
+		0, 0x0C, 0x00, 0x01, 0, 0x10, 0x00, 0x01, 0, 0x28, 0x00, 0x08,
+		0, 0x55, 0x55, 0xAA, 0, 0x4A, 0xAA, 0x55, 0, 0x55, 0x55, 0xA0, 0, 0x40, 0x00, 0x00,
+		2, 0x40, 0x00, 0x00,
+	})
+	// select and latch a clock register, then run the clock
+	f.Add([]byte{0, 0x00, 0x00, 0x0A, 0, 0x40, 0x00, 0x08, 0, 0x60, 0x00, 0x00, 0, 0x60, 0x00, 0x01, 3, 0x00, 0x00, 0xFF, 2, 0xA0, 0x00, 0x00})
+
+	cases := bankControllerCases()
+
+	f.Fuzz(func(t *testing.T, ops []byte) {
+		for _, c := range cases {
+			b := c.new()
+
+			for i := 0; i+4 <= len(ops); i += 4 {
+				addr := uint16(ops[i+1])<<8 | uint16(ops[i+2])
+				value := ops[i+3]
+
+				switch ops[i] % 4 {
+				case 0:
+					b.WriteROM(addr%0x8000, value)
+				case 1:
+					b.WriteRAM(ramOffset+addr%ramBankSize, value)
+				case 2:
+					if addr%0xC000 < 0x8000 {
+						b.Read(addr % 0x8000)
+						continue
+					}
+
+					addr = ramOffset + addr%ramBankSize
+					closed := c.ramClosed(b)
+					if got := b.Read(addr); closed && got != 0xFF {
+						t.Fatalf("%s: read %02X from closed ram at %04X, want FF", c.name, got, addr)
+					}
+				case 3:
+					if clock, ok := b.(interface{ Tick(cycles int) }); ok {
+						clock.Tick(int(addr) * int(value))
+					}
+				}
+			}
+		}
+	})
+}
@@ -1,6 +1,11 @@
 package cartridge
 
-import "fmt"
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+)
 
 type BankController interface {
 	Read(addr uint16) byte
@@ -8,46 +13,237 @@ type BankController interface {
 	WriteRAM(addr uint16, value byte)
 }
 
+// Battery is implemented by bank controllers which keep their state while the
+// Gameboy is switched off.
+type Battery interface {
+	// SaveData returns the state which should be written to the save file.
+	SaveData() []byte
+	// LoadSaveData restores the state previously returned by SaveData.
+	LoadSaveData(data []byte) error
+}
+
+// Infrared is the infrared port of the host, it is given to cartridges which
+// have an infrared LED and sensor.
+type Infrared interface {
+	// SetLED switches the cartridge LED on or off.
+	SetLED(on bool)
+	// Light reports whether the cartridge sensor currently sees light.
+	Light() bool
+}
+
 type Cart struct {
 	BankController
-	title string
+	header *Header
+
+	// clock is set for cartridges which need to count cpu cycles
+	clock interface{ Tick(cycles int) }
+
+	// battery is set when the header says the cartridge ram is battery backed
+	battery  bool
+	savePath string
+	// dirty is set when the ram or flash has been written since the last save
+	dirty bool
+	// saved reports whether the battery backed state has changed, it is nil
+	// when there is no battery. romSaved is set when that state can also be
+	// written through the rom area, like the MBC6 flash.
+	saved    interface{ Dirty() bool }
+	romSaved bool
 }
 
-func NewCart(rom []byte) (*Cart, error) {
-	var cart Cart
+// NewCart creates the bank controller for the rom. When the cartridge has a
+// battery its ram is loaded from savePath, which is also where Save writes it.
+// Cartridges with a real time clock are driven by clock.
+func NewCart(rom []byte, savePath string, clock ClockSource) (*Cart, error) {
+	header, err := ParseHeader(rom)
+	if err != nil {
+		return nil, err
+	}
+
+	cart := Cart{header: header}
 
 	// check what the cartridge type is
-	cartType := rom[0x147]
+	cartType := header.CartType
+	ramSize := header.RAMSize
+
+	// mmm01 carts boot into a menu at the end of the rom, the header at the
+	// start belongs to the first game so check the menu header as well
+	menu := rom[len(rom)-mmm01MenuSize:]
+	if hasMMM01Menu(rom) {
+		cartType = menu[cartTypeAddr]
+		if ramSize, err = ramSizeFromCode(menu[ramSizeAddr]); err != nil {
+			return nil, err
+		}
+	}
+
 	switch cartType {
 	case 0x00:
 		// create a rom only bank controller
 		cart.BankController = NewROM(rom)
 	case 0x01, 0x02, 0x03:
-		// create a rom only bank controller
-		cart.BankController = NewMBC1(rom)
-	case 0x0F, 0x10, 0x11, 0x12, 0x13:
-		// create a rom only bank controller
-		cart.BankController = NewMBC3(rom)
+		cart.BankController = NewMBC1(rom, ramSize)
+	case 0x05, 0x06:
+		cart.BankController = NewMBC2(rom)
+	case 0x0B, 0x0C, 0x0D:
+		cart.BankController = NewMMM01(rom, ramSize)
+	case 0x0F, 0x10:
+		// mbc3 with a real time clock
+		cart.BankController = NewMBC3(rom, ramSize, true, clock)
+	case 0x11, 0x12, 0x13:
+		cart.BankController = NewMBC3(rom, ramSize, false, clock)
+	case 0x19, 0x1A, 0x1B:
+		cart.BankController = NewMBC5(rom, ramSize, false)
+	case 0x1C, 0x1D, 0x1E:
+		// mbc5 with a rumble motor
+		cart.BankController = NewMBC5(rom, ramSize, true)
+	case 0x20:
+		cart.BankController = NewMBC6(rom, ramSize)
+	case 0x22:
+		cart.BankController = NewMBC7(rom)
+	case 0xFE:
+		cart.BankController = NewHuC3(rom, ramSize, clock)
+	case 0xFF:
+		cart.BankController = NewHuC1(rom, ramSize)
 	default:
 		return nil, fmt.Errorf("unsupported rom type: %02X", cartType)
 	}
 
+	if c, ok := cart.BankController.(interface{ Tick(cycles int) }); ok {
+		cart.clock = c
+	}
+
+	if _, ok := cart.BankController.(Battery); ok && hasBattery(cartType) {
+		cart.battery = true
+		cart.savePath = savePath
+
+		if err := cart.loadSave(); err != nil {
+			return nil, fmt.Errorf("loading save %s: %w", savePath, err)
+		}
+
+		cart.saved, _ = cart.BankController.(interface{ Dirty() bool })
+		_, cart.romSaved = cart.BankController.(*MBC6)
+	}
+
 	return &cart, nil
 }
 
-func (c *Cart) Title() string {
-	if c.title != "" {
-		return c.title
+// hasBattery reports whether the cartridge type has battery backed ram.
+func hasBattery(cartType byte) bool {
+	switch cartType {
+	case 0x03, 0x06, 0x09, 0x0D, 0x0F, 0x10, 0x13, 0x1B, 0x1E, 0x20, 0x22, 0xFE, 0xFF:
+		return true
+	default:
+		return false
 	}
+}
 
-	for i := uint16(0x134); i < 0x144; i++ {
-		v := c.Read(i)
-		if v == 0x00 {
-			continue
-		}
+// Tick advances any cartridge hardware which runs off the cpu clock.
+func (c *Cart) Tick(cycles int) {
+	if c.clock != nil {
+		c.clock.Tick(cycles)
+	}
+}
+
+// WriteRAM passes the write on to the bank controller, marking the save as
+// dirty if it was stored in the ram rather than dropped or sent to a port.
+func (c *Cart) WriteRAM(addr uint16, value byte) {
+	c.BankController.WriteRAM(addr, value)
+	c.checkDirty()
+}
 
-		c.title += string(v)
+// WriteROM passes the write on to the bank controller, marking the save as
+// dirty if it changed state which is saved, like the MBC6 flash.
+func (c *Cart) WriteROM(addr uint16, value byte) {
+	c.BankController.WriteROM(addr, value)
+
+	// most writes here switch banks so only check controllers which need it
+	if c.romSaved {
+		c.checkDirty()
 	}
+}
 
-	return c.title
+// checkDirty marks the save as dirty when the bank controller reports that
+// the state it saves has changed.
+func (c *Cart) checkDirty() {
+	if c.saved != nil && c.saved.Dirty() {
+		c.dirty = true
+	}
+}
+
+// loadSave reads the save file into the cartridge, a missing save file is not an error.
+func (c *Cart) loadSave() error {
+	if c.savePath == "" {
+		return nil
+	}
+
+	data, err := os.ReadFile(c.savePath)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+
+	if err != nil {
+		return err
+	}
+
+	return c.BankController.(Battery).LoadSaveData(data)
+}
+
+// Save writes the battery backed state of the cartridge to its save file.
+// The file is written to a temporary file first so a crash mid write does not
+// corrupt the existing save.
+func (c *Cart) Save() error {
+	if !c.battery || c.savePath == "" {
+		return nil
+	}
+
+	tmp := c.savePath + ".tmp"
+	if err := os.WriteFile(tmp, c.BankController.(Battery).SaveData(), 0o644); err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, c.savePath); err != nil {
+		return err
+	}
+
+	c.dirty = false
+
+	return nil
+}
+
+// Flush saves the cartridge if the ram or flash has been written since the last save.
+func (c *Cart) Flush() error {
+	if !c.dirty {
+		return nil
+	}
+
+	return c.Save()
+}
+
+// SetInfrared connects the infrared port of cartridges which have one, without
+// it the sensor never sees any light.
+func (c *Cart) SetInfrared(ir Infrared) {
+	if p, ok := c.BankController.(interface{ SetInfrared(ir Infrared) }); ok {
+		p.SetInfrared(ir)
+	}
+}
+
+// SetTilt sets the tilt in g on each axis for cartridges with an accelerometer.
+func (c *Cart) SetTilt(x, y float64) {
+	if a, ok := c.BankController.(interface{ SetTilt(x, y float64) }); ok {
+		a.SetTilt(x, y)
+	}
+}
+
+// Rumble reports whether the cartridge has a rumble motor which is currently switched on.
+func (c *Cart) Rumble() bool {
+	r, ok := c.BankController.(interface{ Rumble() bool })
+	return ok && r.Rumble()
+}
+
+// Header returns the parsed cartridge header.
+func (c *Cart) Header() *Header {
+	return c.header
+}
+
+func (c *Cart) Title() string {
+	return c.header.Title
 }
@@ -0,0 +1,66 @@
+package cartridge
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestCartDirty(t *testing.T) {
+	tests := []struct {
+		name     string
+		cartType byte
+		// setup writes the registers before the ram write
+		setup     func(c *Cart)
+		wantSaved bool
+	}{
+		{
+			name:     "ram disabled",
+			cartType: 0x03,
+			setup:    func(c *Cart) {},
+		},
+		{
+			name:      "ram enabled",
+			cartType:  0x03,
+			setup:     func(c *Cart) { c.WriteROM(0x0000, 0x0A) },
+			wantSaved: true,
+		},
+		{
+			name:     "huc1 infrared",
+			cartType: 0xFF,
+			setup:    func(c *Cart) { c.WriteROM(0x0000, huc1IRMode) },
+		},
+		{
+			name:      "huc1 ram",
+			cartType:  0xFF,
+			setup:     func(c *Cart) { c.WriteROM(0x0000, 0x0A) },
+			wantSaved: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rom := testROM(fuzzROMBanks, tt.cartType)
+			rom[ramSizeAddr] = 0x02
+			rom[headerChecksumAddr] = headerChecksum(rom)
+
+			save := filepath.Join(t.TempDir(), "game.sav")
+			c, err := NewCart(rom, save, ClockEmulated)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.setup(c)
+			c.WriteRAM(ramOffset, 0x12)
+
+			if err := c.Flush(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, err = os.Stat(save)
+			if saved := err == nil; saved != tt.wantSaved {
+				t.Errorf("save written is %t, want %t", saved, tt.wantSaved)
+			}
+		})
+	}
+}
@@ -0,0 +1,217 @@
+package cartridge
+
+const (
+	eepromCS  = 7
+	eepromCLK = 6
+	eepromDI  = 1
+	eepromDO  = 0
+
+	// a command is a start bit, a two bit opcode and an eight bit address
+	eepromCommandBits = 11
+	eepromWordBits    = 16
+
+	eepromOpExtended = 0x0
+	eepromOpWrite    = 0x1
+	eepromOpRead     = 0x2
+	eepromOpErase    = 0x3
+
+	// extended commands are selected by the top two address bits
+	eepromExtDisable  = 0x0
+	eepromExtWriteAll = 0x1
+	eepromExtEraseAll = 0x2
+	eepromExtEnable   = 0x3
+)
+
+// EEPROM is a 93LC56 serial eeprom organised as 128 16 bit words. It is driven
+// a bit at a time through the chip select, clock and data in lines and
+// answers on the data out line.
+type EEPROM struct {
+	data [256]byte
+
+	cs  bool
+	clk bool
+	di  bool
+	do  bool
+
+	writeEnabled bool
+
+	// shift collects the bits clocked in for the current command
+	shift uint32
+	bits  int
+
+	// reading is set while a word is being clocked out
+	reading  bool
+	readWord uint16
+	readBits int
+	address  byte
+
+	dirtyFlag
+}
+
+func NewEEPROM() *EEPROM {
+	e := &EEPROM{do: true}
+	fill(e.data[:], 0xFF)
+
+	return e
+}
+
+// Read returns the state of the serial lines.
+func (e *EEPROM) Read() byte {
+	var v byte
+	if e.cs {
+		v |= 1 << eepromCS
+	}
+
+	if e.clk {
+		v |= 1 << eepromCLK
+	}
+
+	if e.di {
+		v |= 1 << eepromDI
+	}
+
+	if e.do {
+		v |= 1 << eepromDO
+	}
+
+	return v
+}
+
+// Write sets the serial lines, data is sampled on the rising edge of the clock.
+func (e *EEPROM) Write(value byte) {
+	cs := value&(1<<eepromCS) != 0
+	clk := value&(1<<eepromCLK) != 0
+	e.di = value&(1<<eepromDI) != 0
+
+	if !cs {
+		// dropping chip select abandons the current command
+		e.cs = false
+		e.clk = clk
+		e.reset()
+		return
+	}
+
+	rising := clk && !e.clk
+	e.cs = true
+	e.clk = clk
+
+	if rising {
+		e.clock()
+	}
+}
+
+func (e *EEPROM) reset() {
+	e.shift = 0
+	e.bits = 0
+	e.reading = false
+}
+
+func (e *EEPROM) clock() {
+	if e.reading {
+		e.do = e.readWord&0x8000 != 0
+		e.readWord <<= 1
+		e.readBits++
+
+		// sequential reads continue with the next word
+		if e.readBits == eepromWordBits {
+			e.address = (e.address + 1) & 0x7F
+			e.readWord = e.word(e.address)
+			e.readBits = 0
+		}
+
+		return
+	}
+
+	// wait for the start bit
+	if e.bits == 0 && !e.di {
+		return
+	}
+
+	e.shift = e.shift<<1 | boolBit(e.di)
+	e.bits++
+
+	if e.bits < eepromCommandBits {
+		return
+	}
+
+	op := byte(e.shift >> 8 & 0x3)
+	addr := byte(e.shift)
+
+	switch {
+	case e.bits == eepromCommandBits && op == eepromOpRead:
+		e.address = addr & 0x7F
+		e.readWord = e.word(e.address)
+		e.readBits = 0
+		e.reading = true
+		// a dummy zero bit is sent before the data
+		e.do = false
+
+	case e.bits == eepromCommandBits && op == eepromOpErase:
+		if e.writeEnabled {
+			e.setWord(addr&0x7F, 0xFFFF)
+		}
+
+		e.finish()
+
+	case e.bits == eepromCommandBits && op == eepromOpExtended:
+		switch addr >> 6 {
+		case eepromExtDisable:
+			e.writeEnabled = false
+			e.finish()
+		case eepromExtEnable:
+			e.writeEnabled = true
+			e.finish()
+		case eepromExtEraseAll:
+			if e.writeEnabled {
+				fill(e.data[:], 0xFF)
+				e.setDirty(true)
+			}
+
+			e.finish()
+		}
+
+	case e.bits == eepromCommandBits+eepromWordBits:
+		// writes need the 16 data bits after the command
+		value := uint16(e.shift)
+		cmd := e.shift >> eepromWordBits
+		addr := byte(cmd)
+
+		if e.writeEnabled {
+			switch byte(cmd >> 8 & 0x3) {
+			case eepromOpWrite:
+				e.setWord(addr&0x7F, value)
+			case eepromOpExtended:
+				for i := byte(0); i < 128; i++ {
+					e.setWord(i, value)
+				}
+			}
+		}
+
+		e.finish()
+	}
+}
+
+// finish completes a command, writes complete instantly so data out reports ready.
+func (e *EEPROM) finish() {
+	e.shift = 0
+	e.bits = 0
+	e.do = true
+}
+
+func (e *EEPROM) word(addr byte) uint16 {
+	return uint16(e.data[int(addr)*2]) | uint16(e.data[int(addr)*2+1])<<8
+}
+
+func (e *EEPROM) setWord(addr byte, value uint16) {
+	e.data[int(addr)*2] = byte(value)
+	e.data[int(addr)*2+1] = byte(value >> 8)
+	e.setDirty(true)
+}
+
+func boolBit(b bool) uint32 {
+	if b {
+		return 1
+	}
+
+	return 0
+}
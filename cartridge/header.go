@@ -0,0 +1,204 @@
+package cartridge
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+const (
+	titleStart            = 0x134
+	titleEnd              = 0x144
+	manufacturerCodeStart = 0x13F
+	cgbFlagAddr           = 0x143
+	newLicenseeAddr       = 0x144
+	sgbFlagAddr           = 0x146
+	cartTypeAddr          = 0x147
+	romSizeAddr           = 0x148
+	ramSizeAddr           = 0x149
+	destinationAddr       = 0x14A
+	oldLicenseeAddr       = 0x14B
+	versionAddr           = 0x14C
+	headerChecksumAddr    = 0x14D
+	globalChecksumAddr    = 0x14E
+	headerEnd             = 0x150
+
+	// useNewLicensee is the old licensee code which means the new licensee code should be used
+	useNewLicensee = 0x33
+)
+
+var (
+	ErrHeaderChecksum = errors.New("header checksum mismatch")
+	ErrGlobalChecksum = errors.New("global checksum mismatch")
+)
+
+// Header contains the cartridge information stored at 0x0100-0x014F of the rom.
+type Header struct {
+	Title string
+	// ManufacturerCode is only present on newer cartridges, it is empty otherwise
+	ManufacturerCode string
+	CGBFlag          byte
+	// Licensee is the two character licensee code, older cartridges store a
+	// single byte which is formatted as hex
+	Licensee    string
+	SGBFlag     byte
+	CartType    byte
+	ROMSize     int
+	RAMSize     int
+	Destination byte
+	Version     byte
+
+	HeaderChecksum byte
+	GlobalChecksum uint16
+}
+
+// ParseHeader reads the cartridge header from the rom, checking that the rom
+// is large enough for the sizes it declares. The checksums aren't checked
+// since plenty of homebrew and hacked roms get them wrong.
+func ParseHeader(rom []byte) (*Header, error) {
+	if len(rom) < headerEnd {
+		return nil, fmt.Errorf("rom is too small to contain a header: %d bytes", len(rom))
+	}
+
+	romSize, err := romSizeFromCode(rom[romSizeAddr])
+	if err != nil {
+		return nil, err
+	}
+
+	ramSize, err := ramSizeFromCode(rom[ramSizeAddr])
+	if err != nil {
+		return nil, err
+	}
+
+	if len(rom) < romSize {
+		return nil, fmt.Errorf("rom is truncated: header declares %d bytes but image is %d bytes", romSize, len(rom))
+	}
+
+	h := &Header{
+		CGBFlag:        rom[cgbFlagAddr],
+		SGBFlag:        rom[sgbFlagAddr],
+		CartType:       rom[cartTypeAddr],
+		ROMSize:        romSize,
+		RAMSize:        ramSize,
+		Destination:    rom[destinationAddr],
+		Version:        rom[versionAddr],
+		HeaderChecksum: rom[headerChecksumAddr],
+		GlobalChecksum: binary.BigEndian.Uint16(rom[globalChecksumAddr:]),
+	}
+
+	// cgb cartridges use the last byte of the title for the cgb flag and newer
+	// ones use the four bytes before it for the manufacturer code
+	title := rom[titleStart:titleEnd]
+	if h.CGBFlag&0x80 != 0 {
+		title = rom[titleStart:cgbFlagAddr]
+
+		code := rom[manufacturerCodeStart:cgbFlagAddr]
+		if isManufacturerCode(code) {
+			h.ManufacturerCode = string(code)
+			title = rom[titleStart:manufacturerCodeStart]
+		}
+	}
+
+	h.Title = parseTitle(title)
+
+	if rom[oldLicenseeAddr] == useNewLicensee {
+		h.Licensee = string(rom[newLicenseeAddr : newLicenseeAddr+2])
+	} else {
+		h.Licensee = fmt.Sprintf("%02X", rom[oldLicenseeAddr])
+	}
+
+	return h, nil
+}
+
+// VerifyHeaderChecksum checks the checksum over the header. The boot rom
+// locks up when it doesn't match, without the boot rom the game runs anyway.
+func (h *Header) VerifyHeaderChecksum(rom []byte) error {
+	if sum := headerChecksum(rom); sum != h.HeaderChecksum {
+		return fmt.Errorf("%w: header has %02X but computed %02X", ErrHeaderChecksum, h.HeaderChecksum, sum)
+	}
+
+	return nil
+}
+
+// VerifyGlobalChecksum checks the checksum over the whole rom. The Gameboy
+// never checks it so a mismatch does not stop a game from running.
+func (h *Header) VerifyGlobalChecksum(rom []byte) error {
+	var sum uint16
+	for i, v := range rom {
+		if i == globalChecksumAddr || i == globalChecksumAddr+1 {
+			continue
+		}
+
+		sum += uint16(v)
+	}
+
+	if sum != h.GlobalChecksum {
+		return fmt.Errorf("%w: header has %04X but computed %04X", ErrGlobalChecksum, h.GlobalChecksum, sum)
+	}
+
+	return nil
+}
+
+func headerChecksum(rom []byte) byte {
+	var sum byte
+	for i := titleStart; i < headerChecksumAddr; i++ {
+		sum = sum - rom[i] - 1
+	}
+
+	return sum
+}
+
+func romSizeFromCode(code byte) (int, error) {
+	switch {
+	case code <= 0x08:
+		return 0x8000 << code, nil
+	// unofficial sizes which are listed in some documentation
+	case code == 0x52:
+		return 72 * romBankSize, nil
+	case code == 0x53:
+		return 80 * romBankSize, nil
+	case code == 0x54:
+		return 96 * romBankSize, nil
+	default:
+		return 0, fmt.Errorf("unknown rom size code: %02X", code)
+	}
+}
+
+func ramSizeFromCode(code byte) (int, error) {
+	switch code {
+	case 0x00:
+		return 0, nil
+	case 0x01:
+		// unused by licensed games but some homebrew uses it for 2KB
+		return 0x800, nil
+	case 0x02:
+		return ramBankSize, nil
+	case 0x03:
+		return 4 * ramBankSize, nil
+	case 0x04:
+		return 16 * ramBankSize, nil
+	case 0x05:
+		return 8 * ramBankSize, nil
+	default:
+		return 0, fmt.Errorf("unknown ram size code: %02X", code)
+	}
+}
+
+func isManufacturerCode(code []byte) bool {
+	for _, c := range code {
+		if c < 'A' || c > 'Z' {
+			return false
+		}
+	}
+
+	return true
+}
+
+func parseTitle(b []byte) string {
+	if i := strings.IndexByte(string(b), 0); i >= 0 {
+		b = b[:i]
+	}
+
+	return strings.TrimSpace(string(b))
+}
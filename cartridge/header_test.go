@@ -0,0 +1,198 @@
+package cartridge
+
+import (
+	"errors"
+	"testing"
+)
+
+// headerROM returns a 32KB rom with the title and licensee set, edit changes
+// it before the header checksum is written.
+func headerROM(title string, edit func(rom []byte)) []byte {
+	rom := make([]byte, 2*romBankSize)
+	copy(rom[titleStart:], title)
+	rom[oldLicenseeAddr] = 0x01
+
+	if edit != nil {
+		edit(rom)
+	}
+
+	rom[headerChecksumAddr] = headerChecksum(rom)
+
+	return rom
+}
+
+func TestParseHeader(t *testing.T) {
+	tests := []struct {
+		name string
+		rom  []byte
+
+		title            string
+		manufacturerCode string
+		licensee         string
+		romSize          int
+		ramSize          int
+	}{
+		{
+			name:     "dmg",
+			rom:      headerROM("TETRIS", nil),
+			title:    "TETRIS",
+			licensee: "01",
+			romSize:  0x8000,
+		},
+		{
+			name:     "full length title",
+			rom:      headerROM("ABCDEFGHIJKLMNOP", nil),
+			title:    "ABCDEFGHIJKLMNOP",
+			licensee: "01",
+			romSize:  0x8000,
+		},
+		{
+			name: "cgb with manufacturer code",
+			rom: headerROM("ZELDA", func(rom []byte) {
+				copy(rom[manufacturerCodeStart:], "AZLE")
+				rom[cgbFlagAddr] = 0x80
+			}),
+			title:            "ZELDA",
+			manufacturerCode: "AZLE",
+			licensee:         "01",
+			romSize:          0x8000,
+		},
+		{
+			name: "cgb without manufacturer code",
+			rom: headerROM("POKEMON YELLOW", func(rom []byte) {
+				rom[cgbFlagAddr] = 0xC0
+			}),
+			title:    "POKEMON YELLOW",
+			licensee: "01",
+			romSize:  0x8000,
+		},
+		{
+			name: "new licensee",
+			rom: headerROM("GAME", func(rom []byte) {
+				rom[oldLicenseeAddr] = useNewLicensee
+				copy(rom[newLicenseeAddr:], "01")
+			}),
+			title:    "GAME",
+			licensee: "01",
+			romSize:  0x8000,
+		},
+		{
+			name: "old licensee",
+			rom: headerROM("GAME", func(rom []byte) {
+				rom[oldLicenseeAddr] = 0xA4
+				copy(rom[newLicenseeAddr:], "01")
+			}),
+			title:    "GAME",
+			licensee: "A4",
+			romSize:  0x8000,
+		},
+		{
+			name: "ram size",
+			rom: headerROM("GAME", func(rom []byte) {
+				rom[ramSizeAddr] = 0x03
+			}),
+			title:    "GAME",
+			licensee: "01",
+			romSize:  0x8000,
+			ramSize:  4 * ramBankSize,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h, err := ParseHeader(tt.rom)
+			if err != nil {
+				t.Fatalf("ParseHeader() error: %v", err)
+			}
+
+			if h.Title != tt.title {
+				t.Errorf("Title = %q, want %q", h.Title, tt.title)
+			}
+
+			if h.ManufacturerCode != tt.manufacturerCode {
+				t.Errorf("ManufacturerCode = %q, want %q", h.ManufacturerCode, tt.manufacturerCode)
+			}
+
+			if h.Licensee != tt.licensee {
+				t.Errorf("Licensee = %q, want %q", h.Licensee, tt.licensee)
+			}
+
+			if h.ROMSize != tt.romSize {
+				t.Errorf("ROMSize = %d, want %d", h.ROMSize, tt.romSize)
+			}
+
+			if h.RAMSize != tt.ramSize {
+				t.Errorf("RAMSize = %d, want %d", h.RAMSize, tt.ramSize)
+			}
+		})
+	}
+}
+
+func TestParseHeaderErrors(t *testing.T) {
+	tests := []struct {
+		name string
+		rom  []byte
+	}{
+		{name: "too small", rom: make([]byte, headerEnd-1)},
+		{name: "truncated", rom: headerROM("GAME", func(rom []byte) { rom[romSizeAddr] = 0x01 })},
+		{name: "unknown rom size", rom: headerROM("GAME", func(rom []byte) { rom[romSizeAddr] = 0x09 })},
+		{name: "unknown ram size", rom: headerROM("GAME", func(rom []byte) { rom[ramSizeAddr] = 0x06 })},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if h, err := ParseHeader(tt.rom); err == nil {
+				t.Fatalf("ParseHeader() = %+v, want an error", h)
+			}
+		})
+	}
+}
+
+func TestVerifyHeaderChecksum(t *testing.T) {
+	rom := headerROM("GAME", nil)
+
+	h, err := ParseHeader(rom)
+	if err != nil {
+		t.Fatalf("ParseHeader() error: %v", err)
+	}
+
+	if err := h.VerifyHeaderChecksum(rom); err != nil {
+		t.Errorf("VerifyHeaderChecksum() error: %v", err)
+	}
+
+	// a bad checksum is only reported by VerifyHeaderChecksum so the rom still loads
+	rom[headerChecksumAddr]++
+	if h, err = ParseHeader(rom); err != nil {
+		t.Fatalf("ParseHeader() error: %v", err)
+	}
+
+	if err := h.VerifyHeaderChecksum(rom); !errors.Is(err, ErrHeaderChecksum) {
+		t.Errorf("VerifyHeaderChecksum() error = %v, want %v", err, ErrHeaderChecksum)
+	}
+}
+
+func TestVerifyGlobalChecksum(t *testing.T) {
+	rom := headerROM("GAME", nil)
+
+	var sum uint16
+	for _, v := range rom {
+		sum += uint16(v)
+	}
+
+	rom[globalChecksumAddr] = byte(sum >> 8)
+	rom[globalChecksumAddr+1] = byte(sum)
+
+	h, err := ParseHeader(rom)
+	if err != nil {
+		t.Fatalf("ParseHeader() error: %v", err)
+	}
+
+	if err := h.VerifyGlobalChecksum(rom); err != nil {
+		t.Errorf("VerifyGlobalChecksum() error: %v", err)
+	}
+
+	rom[0x200]++
+	if err := h.VerifyGlobalChecksum(rom); !errors.Is(err, ErrGlobalChecksum) {
+		t.Errorf("VerifyGlobalChecksum() error = %v, want %v", err, ErrGlobalChecksum)
+	}
+}
@@ -0,0 +1,109 @@
+package cartridge
+
+const (
+	hucIRSelectRegister = 0x2000
+	hucROMBankRegister  = 0x4000
+	hucRAMBankRegister  = 0x6000
+
+	// huc1IRMode is written to the ir select register to map the infrared port over the ram
+	huc1IRMode = 0x0E
+
+	// irNoLight and irLight are the values read from the infrared port
+	irNoLight = 0xC0
+	irLight   = 0xC1
+)
+
+// HuC1 is the Hudson bank controller, it is similar to MBC1 but has an
+// infrared port which can be mapped in place of the RAM.
+type HuC1 struct {
+	rom     []byte
+	romBank int
+
+	ram     []byte
+	ramBank int
+
+	// irMode maps the infrared port into 0xA000-0xBFFF instead of the ram
+	irMode bool
+	ir     Infrared
+
+	dirtyFlag
+}
+
+func NewHuC1(rom []byte, ramSize int) *HuC1 {
+	return &HuC1{
+		rom:     rom,
+		ram:     make([]byte, ramSize),
+		romBank: 1,
+	}
+}
+
+// Read implements BankController.
+func (m *HuC1) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000: // fixed bank 0
+		return readBank(m.rom, 0, romBankSize, addr)
+	case addr < 0x8000: // variable rom bank
+		return readBank(m.rom, m.romBank, romBankSize, addr-romOffset)
+	case m.irMode:
+		return readInfrared(m.ir)
+	default: // reading from the ram bank
+		return readBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset)
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *HuC1) WriteRAM(addr uint16, value byte) {
+	if m.irMode {
+		if m.ir != nil {
+			m.ir.SetLED(value&0x1 == 1)
+		}
+
+		return
+	}
+
+	m.setDirty(writeBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset, value))
+}
+
+// WriteROM implements BankController.
+func (m *HuC1) WriteROM(addr uint16, value byte) {
+	switch {
+	case addr < hucIRSelectRegister:
+		// there is no ram enable, anything other than the ir mode selects the ram
+		m.irMode = value&0xF == huc1IRMode
+
+	case addr < hucROMBankRegister:
+		m.romBank = int(value & 0x3F)
+		if m.romBank == 0 {
+			m.romBank = 1
+		}
+
+	case addr < hucRAMBankRegister:
+		m.ramBank = int(value & 0x3)
+	}
+}
+
+// SetInfrared connects the infrared port to the frontend.
+func (m *HuC1) SetInfrared(ir Infrared) {
+	m.ir = ir
+}
+
+// SaveData implements Battery.
+func (m *HuC1) SaveData() []byte {
+	return append([]byte(nil), m.ram...)
+}
+
+// LoadSaveData implements Battery.
+func (m *HuC1) LoadSaveData(data []byte) error {
+	copy(m.ram, data)
+	return nil
+}
+
+// readInfrared returns the value of the infrared port, without a frontend
+// connected the sensor never sees any light.
+func readInfrared(ir Infrared) byte {
+	if ir != nil && ir.Light() {
+		return irLight
+	}
+
+	return irNoLight
+}
@@ -0,0 +1,282 @@
+package cartridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	// values written to the mode register to select what is mapped at 0xA000-0xBFFF
+	huc3ModeRAMRead     = 0x0
+	huc3ModeRAMWrite    = 0xA
+	huc3ModeRTCCommand  = 0xB
+	huc3ModeRTCResponse = 0xC
+	huc3ModeRTCReady    = 0xD
+	huc3ModeIR          = 0xE
+
+	// rtc commands sent in the upper nibble of a command write
+	huc3CommandRead         = 0x1
+	huc3CommandWrite        = 0x2
+	huc3CommandWriteNext    = 0x3
+	huc3CommandAddressLow   = 0x4
+	huc3CommandAddressHigh  = 0x5
+	huc3CommandExtended     = 0x6
+	huc3AddressMinutes      = 0x00
+	huc3AddressDays         = 0x03
+	huc3AddressAlarmMinutes = 0x58
+	huc3AddressAlarmDays    = 0x5B
+	huc3AddressAlarmEnabled = 0x5F
+
+	minutesPerDay = 24 * 60
+
+	// huc3SaveSize is the size of the clock footer appended to the save ram,
+	// this is the same layout SameBoy uses
+	huc3SaveSize = 17
+)
+
+// HuC3 is the Hudson bank controller with a real time clock, infrared port
+// and a speaker. The clock is driven through a small command interface
+// instead of being mapped directly into memory.
+type HuC3 struct {
+	rom     []byte
+	romBank int
+
+	ram     []byte
+	ramBank int
+
+	mode byte
+	ir   Infrared
+
+	source ClockSource
+	// minutes is the minute of the current day and days counts the days
+	minutes uint16
+	days    uint16
+	// cycles counts emulated cycles towards the next minute
+	cycles   int
+	lastSync time.Time
+
+	alarmMinutes uint16
+	alarmDays    uint16
+	alarmEnabled bool
+
+	// address is the clock memory address used by read and write commands
+	address byte
+	// command and result make up the response read back in the response mode
+	command byte
+	result  byte
+
+	dirtyFlag
+}
+
+func NewHuC3(rom []byte, ramSize int, clock ClockSource) *HuC3 {
+	return &HuC3{
+		rom:      rom,
+		ram:      make([]byte, ramSize),
+		romBank:  1,
+		source:   clock,
+		lastSync: time.Now(),
+	}
+}
+
+// Read implements BankController.
+func (m *HuC3) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000: // fixed bank 0
+		return readBank(m.rom, 0, romBankSize, addr)
+	case addr < 0x8000: // variable rom bank
+		return readBank(m.rom, m.romBank, romBankSize, addr-romOffset)
+	}
+
+	switch m.mode {
+	case huc3ModeRAMRead, huc3ModeRAMWrite:
+		return readBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset)
+	case huc3ModeRTCResponse:
+		return m.command<<4 | m.result
+	case huc3ModeRTCReady:
+		// commands run instantly so the clock is always ready
+		return 0x01
+	case huc3ModeIR:
+		return readInfrared(m.ir)
+	default:
+		return 0xFF
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *HuC3) WriteRAM(addr uint16, value byte) {
+	switch m.mode {
+	case huc3ModeRAMWrite:
+		m.setDirty(writeBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset, value))
+	case huc3ModeRTCCommand:
+		m.runCommand(value>>4&0x7, value&0xF)
+	case huc3ModeIR:
+		if m.ir != nil {
+			m.ir.SetLED(value&0x1 == 1)
+		}
+	}
+}
+
+// WriteROM implements BankController.
+func (m *HuC3) WriteROM(addr uint16, value byte) {
+	switch {
+	case addr < hucIRSelectRegister:
+		m.mode = value & 0xF
+
+	case addr < hucROMBankRegister:
+		m.romBank = int(value & 0x7F)
+		if m.romBank == 0 {
+			m.romBank = 1
+		}
+
+	case addr < hucRAMBankRegister:
+		m.ramBank = int(value & 0xF)
+	}
+}
+
+// runCommand executes a clock command, the clock memory is accessed a nibble
+// at a time through the address set by the address commands.
+func (m *HuC3) runCommand(command, arg byte) {
+	m.sync()
+	m.command = command
+
+	switch command {
+	case huc3CommandRead:
+		m.result = m.readClock(m.address)
+		m.address++
+	case huc3CommandWrite, huc3CommandWriteNext:
+		m.writeClock(m.address, arg)
+		m.setDirty(true)
+		if command == huc3CommandWriteNext {
+			m.address++
+		}
+	case huc3CommandAddressLow:
+		m.address = m.address&0xF0 | arg
+	case huc3CommandAddressHigh:
+		m.address = m.address&0x0F | arg<<4
+	case huc3CommandExtended:
+		// extended commands control the speaker and clock latching which
+		// are not needed as the clock is always up to date
+		m.result = 0x1
+	}
+}
+
+func (m *HuC3) readClock(address byte) byte {
+	switch {
+	case address < huc3AddressDays:
+		return byte(m.minutes>>(4*address)) & 0xF
+	case address < huc3AddressDays+4:
+		return byte(m.days>>(4*(address-huc3AddressDays))) & 0xF
+	default:
+		return 0
+	}
+}
+
+func (m *HuC3) writeClock(address, value byte) {
+	switch {
+	case address < huc3AddressDays:
+		m.minutes = setNibble(m.minutes, address, value)
+		m.cycles = 0
+	case address < huc3AddressDays+4:
+		m.days = setNibble(m.days, address-huc3AddressDays, value)
+	case address >= huc3AddressAlarmMinutes && address < huc3AddressAlarmDays:
+		m.alarmMinutes = setNibble(m.alarmMinutes, address-huc3AddressAlarmMinutes, value)
+	case address >= huc3AddressAlarmDays && address < huc3AddressAlarmEnabled:
+		m.alarmDays = setNibble(m.alarmDays, address-huc3AddressAlarmDays, value)
+	case address == huc3AddressAlarmEnabled:
+		m.alarmEnabled = value&0x1 == 1
+	}
+}
+
+// setNibble replaces the nth nibble of v.
+func setNibble(v uint16, n, value byte) uint16 {
+	shift := 4 * n
+	return v&^(0xF<<shift) | uint16(value&0xF)<<shift
+}
+
+// Tick advances the clock by the given number of cpu cycles when it is driven by emulated time.
+func (m *HuC3) Tick(cycles int) {
+	if m.source != ClockEmulated {
+		return
+	}
+
+	m.cycles += cycles
+	for m.cycles >= 60*cyclesPerSecond {
+		m.cycles -= 60 * cyclesPerSecond
+		m.advance(1)
+	}
+}
+
+// sync brings the clock up to date with the host time.
+func (m *HuC3) sync() {
+	now := time.Now()
+	if m.source != ClockHost {
+		m.lastSync = now
+		return
+	}
+
+	elapsed := int64(now.Sub(m.lastSync) / time.Minute)
+	if elapsed < 0 {
+		m.lastSync = now
+		return
+	}
+
+	// only move forward by whole minutes so the remainder is not lost
+	m.lastSync = m.lastSync.Add(time.Duration(elapsed) * time.Minute)
+	m.advance(elapsed)
+}
+
+// advance moves the clock forward by the given number of minutes.
+func (m *HuC3) advance(minutes int64) {
+	total := int64(m.minutes) + minutes
+	m.days += uint16(total / minutesPerDay)
+	m.minutes = uint16(total % minutesPerDay)
+}
+
+// SetInfrared connects the infrared port to the frontend.
+func (m *HuC3) SetInfrared(ir Infrared) {
+	m.ir = ir
+}
+
+// SaveData implements Battery.
+func (m *HuC3) SaveData() []byte {
+	m.sync()
+
+	footer := make([]byte, huc3SaveSize)
+	binary.LittleEndian.PutUint64(footer, uint64(m.lastSync.Unix()))
+	binary.LittleEndian.PutUint16(footer[8:], m.minutes)
+	binary.LittleEndian.PutUint16(footer[10:], m.days)
+	binary.LittleEndian.PutUint16(footer[12:], m.alarmMinutes)
+	binary.LittleEndian.PutUint16(footer[14:], m.alarmDays)
+	if m.alarmEnabled {
+		footer[16] = 1
+	}
+
+	return append(append([]byte(nil), m.ram...), footer...)
+}
+
+// LoadSaveData implements Battery.
+func (m *HuC3) LoadSaveData(data []byte) error {
+	footerSize := len(data) % 0x400
+	copy(m.ram, data[:len(data)-footerSize])
+
+	if footerSize == 0 {
+		return nil
+	}
+
+	if footerSize != huc3SaveSize {
+		return fmt.Errorf("invalid huc3 clock save size: %d", footerSize)
+	}
+
+	footer := data[len(data)-footerSize:]
+	m.lastSync = time.Unix(int64(binary.LittleEndian.Uint64(footer)), 0)
+	m.minutes = binary.LittleEndian.Uint16(footer[8:]) % minutesPerDay
+	m.days = binary.LittleEndian.Uint16(footer[10:])
+	m.alarmMinutes = binary.LittleEndian.Uint16(footer[12:])
+	m.alarmDays = binary.LittleEndian.Uint16(footer[14:])
+	m.alarmEnabled = footer[16] == 1
+	m.cycles = 0
+	m.sync()
+
+	return nil
+}
@@ -1,52 +1,72 @@
 package cartridge
 
+import "bytes"
+
 const (
 	mbc1RAMEnableRegister = 0x2000
 	mbc1ROMBankRegister   = 0x4000
 	mbc1RAMBankRegister   = 0x6000
+	mbc1ModeRegister      = 0x8000
 
 	romOffset   = 0x4000
 	ramOffset   = 0xA000
 	romBankSize = 0x4000
 	ramBankSize = 0x2000
+
+	// multicart roms are made of 256KB games, each with their own header
+	mbc1MulticartSize     = 64 * romBankSize
+	mbc1MulticartGameSize = 16 * romBankSize
+
+	logoStart = 0x104
+	logoEnd   = 0x134
 )
 
 type MBC1 struct {
-	rom     []byte
-	romBank int
+	rom []byte
+	// bank1 is the primary 5 bit bank register which selects the lower bits of the rom bank
+	bank1 byte
+	// bank2 is the secondary 2 bit register, it selects the upper rom bank bits
+	// on large roms or the ram bank
+	bank2 byte
+	// mode is the banking mode, when set bank2 also applies to the fixed rom area and the ram
+	mode bool
+	// multicart is set for MBC1M cartridges, these only wire 4 bits of the
+	// primary register so bank2 selects bits 4-5 of the rom bank
+	multicart bool
 
 	ram        []byte
-	ramBank    int
 	ramEnabled bool
+
+	dirtyFlag
 }
 
-func NewMBC1(rom []byte) *MBC1 {
+func NewMBC1(rom []byte, ramSize int) *MBC1 {
 	return &MBC1{
-		rom:     rom,
-		ram:     make([]byte, 4*ramBankSize),
-		romBank: 1,
+		rom:       rom,
+		ram:       make([]byte, ramSize),
+		bank1:     1,
+		multicart: isMulticart(rom),
 	}
 }
 
 // Read implements BankController.
 func (m *MBC1) Read(addr uint16) byte {
 	switch {
-	case addr < 0x4000: // fixed bank 0
-		return m.rom[addr]
+	case addr < 0x4000: // bank 0, or bank2 in mode 1
+		return readBank(m.rom, m.lowBank(), romBankSize, addr)
 	case addr < 0x8000: // variable rom bank
-		offset := uint32(m.romBank*romBankSize) - romOffset
-		return m.rom[uint32(addr)+offset]
+		return readBank(m.rom, m.highBank(), romBankSize, addr-romOffset)
+	case !m.ramEnabled: // ram is disabled
+		return 0xFF
 	default: // reading from the ram bank
-		offset := uint32(m.ramBank*ramBankSize) - ramOffset
-		return m.ram[uint32(addr)+offset]
+		return readBank(m.ram, m.ramBank(), ramBankSize, addr-ramOffset)
 	}
 }
 
 // WriteRAM implements BankController.
 func (m *MBC1) WriteRAM(addr uint16, value byte) {
 	if m.ramEnabled {
-		offset := uint32(m.ramBank*ramBankSize) - ramOffset
-		m.ram[uint32(addr)+offset] = value
+		m.setDirty(writeBank(m.ram, m.ramBank(), ramBankSize, addr-ramOffset, value))
 	}
 }
 
@@ -57,20 +77,77 @@ func (m *MBC1) WriteROM(addr uint16, value byte) {
 		m.ramEnabled = (value & 0xF) == 0xA
 
 	case addr < mbc1ROMBankRegister:
-		// TODO: handle large roms with added banking
-		b := value & 0x1F
-		m.romBank = translateBank(b)
+		// a value of zero is translated to one, only the full 5 bits are
+		// checked so on multicarts 0x10 still maps the first bank of a game
+		m.bank1 = value & 0x1F
+		if m.bank1 == 0 {
+			m.bank1 = 1
+		}
 
 	case addr < mbc1RAMBankRegister:
-		m.ramBank = int(value & 0x3)
+		m.bank2 = value & 0x3
+
+	case addr < mbc1ModeRegister:
+		m.mode = value&0x1 == 1
+	}
+}
+
+// lowBank returns the rom bank mapped at 0x0000-0x3FFF.
+func (m *MBC1) lowBank() int {
+	if !m.mode {
+		return 0
+	}
+
+	return m.upperBits()
+}
+
+// highBank returns the rom bank mapped at 0x4000-0x7FFF.
+func (m *MBC1) highBank() int {
+	if m.multicart {
+		return m.upperBits() | int(m.bank1&0xF)
+	}
+
+	return m.upperBits() | int(m.bank1)
+}
+
+// upperBits returns the bank2 register shifted into place in the rom bank number.
+func (m *MBC1) upperBits() int {
+	if m.multicart {
+		return int(m.bank2) << 4
 	}
+
+	return int(m.bank2) << 5
 }
 
-// translateBank handles translating invalid rom bank numbers to valid ones.
-func translateBank(bank byte) int {
-	if bank == 0x00 || bank == 0x20 || bank == 0x40 || bank == 0x60 {
-		return int(bank) + 1
+// ramBank returns the selected ram bank, ram banking is only used in mode 1.
+func (m *MBC1) ramBank() int {
+	if !m.mode {
+		return 0
 	}
 
-	return int(bank)
+	return int(m.bank2)
+}
+
+// isMulticart detects MBC1M compilation cartridges. These are 1MB and have a
+// second game header, including the Nintendo logo, at the start of bank 0x10.
+func isMulticart(rom []byte) bool {
+	if len(rom) != mbc1MulticartSize {
+		return false
+	}
+
+	logo := rom[logoStart:logoEnd]
+	game := rom[mbc1MulticartGameSize+logoStart : mbc1MulticartGameSize+logoEnd]
+
+	return bytes.Equal(logo, game)
+}
+
+// SaveData implements Battery.
+func (m *MBC1) SaveData() []byte {
+	return append([]byte(nil), m.ram...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MBC1) LoadSaveData(data []byte) error {
+	copy(m.ram, data)
+	return nil
 }
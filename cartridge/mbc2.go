@@ -0,0 +1,87 @@
+package cartridge
+
+const (
+	mbc2RegisterEnd = 0x4000
+	// mbc2RegisterSelectBit is the address bit which selects between the ram
+	// enable register and the rom bank register
+	mbc2RegisterSelectBit = 8
+
+	// mbc2RAMSize is the number of half bytes of ram built into the MBC2 chip
+	mbc2RAMSize = 0x200
+)
+
+// MBC2 supports up to 256KB of ROM and has 512 half bytes of RAM built into the chip.
+type MBC2 struct {
+	rom     []byte
+	romBank int
+
+	// ram only stores the lower nibble of each byte
+	ram        [mbc2RAMSize]byte
+	ramEnabled bool
+
+	dirtyFlag
+}
+
+func NewMBC2(rom []byte) *MBC2 {
+	return &MBC2{
+		rom:     rom,
+		romBank: 1,
+	}
+}
+
+// Read implements BankController.
+func (m *MBC2) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000: // fixed bank 0
+		return readBank(m.rom, 0, romBankSize, addr)
+	case addr < 0x8000: // variable rom bank
+		return readBank(m.rom, m.romBank, romBankSize, addr-romOffset)
+	case !m.ramEnabled:
+		return 0xFF
+	default: // the 512 bytes of ram are echoed across the whole ram area
+		// the upper four bits are not connected and read back as set
+		return m.ram[addr&(mbc2RAMSize-1)] | 0xF0
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *MBC2) WriteRAM(addr uint16, value byte) {
+	if m.ramEnabled {
+		m.ram[addr&(mbc2RAMSize-1)] = value & 0x0F
+		m.setDirty(true)
+	}
+}
+
+// WriteROM implements BankController.
+func (m *MBC2) WriteROM(addr uint16, value byte) {
+	if addr >= mbc2RegisterEnd {
+		return
+	}
+
+	// bit 8 of the address selects the register
+	if addr&(1<<mbc2RegisterSelectBit) == 0 {
+		m.ramEnabled = (value & 0xF) == 0xA
+		return
+	}
+
+	m.romBank = int(value & 0xF)
+	if m.romBank == 0 {
+		m.romBank = 1
+	}
+}
+
+// SaveData implements Battery.
+func (m *MBC2) SaveData() []byte {
+	return append([]byte(nil), m.ram[:]...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MBC2) LoadSaveData(data []byte) error {
+	copy(m.ram[:], data)
+
+	for i := range m.ram {
+		m.ram[i] &= 0x0F
+	}
+
+	return nil
+}
@@ -1,5 +1,7 @@
 package cartridge
 
+const mbc3LatchRegister = 0x8000
+
 type MBC3 struct {
 	rom     []byte
 	romBank int
@@ -7,26 +9,47 @@ type MBC3 struct {
 	ram        []byte
 	ramBank    int
 	ramEnabled bool
+
+	// rtc is nil for cartridges without a timer
+	rtc *RTC
+	// latch is the last value written to the latch register, the clock is
+	// latched when a 0x00 write is followed by a 0x01 write
+	latch byte
+
+	dirtyFlag
 }
 
-func NewMBC3(rom []byte) *MBC3 {
-	return &MBC3{
+func NewMBC3(rom []byte, ramSize int, hasTimer bool, clock ClockSource) *MBC3 {
+	m := &MBC3{
 		rom:     rom,
-		ram:     make([]byte, 4*ramBankSize),
+		ram:     make([]byte, ramSize),
 		romBank: 1,
+		latch:   0xFF,
+	}
+
+	if hasTimer {
+		m.rtc = NewRTC(clock)
 	}
+
+	return m
 }
 
 func (m *MBC3) Read(addr uint16) byte {
 	switch {
 	case addr < 0x4000: // fixed bank 0
-		return m.rom[addr]
+		return readBank(m.rom, 0, romBankSize, addr)
 	case addr < 0x8000: // variable rom bank
-		offset := uint32(m.romBank*romBankSize) - romOffset
-		return m.rom[uint32(addr)+offset]
+		return readBank(m.rom, m.romBank, romBankSize, addr-romOffset)
+	case !m.ramEnabled: // ram and clock are disabled
+		return 0xFF
+	case m.ramBank >= rtcSeconds: // reading from a clock register
+		if m.rtc == nil {
+			return 0xFF
+		}
+
+		return m.rtc.Read(m.ramBank)
 	default: // reading from the ram bank
-		offset := uint32(m.ramBank*ramBankSize) - ramOffset
-		return m.ram[uint32(addr)+offset]
+		return readBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset)
 	}
 }
 
@@ -36,7 +59,7 @@ func (m *MBC3) WriteROM(addr uint16, value byte) {
 		m.ramEnabled = (value & 0xF) == 0xA
 
 	case addr < mbc1ROMBankRegister:
-		// TODO: handle large roms with added banking
+		// all 8 bits are kept for the 4MB MBC30, smaller roms wrap the bank number
 		if value == 0x00 {
 			value = 0x01
 		}
@@ -44,13 +67,70 @@ func (m *MBC3) WriteROM(addr uint16, value byte) {
 		m.romBank = int(value)
 
 	case addr < mbc1RAMBankRegister:
-		m.ramBank = int(value & 0x3)
+		// 0x00-0x07 select a ram bank and 0x08-0x0C select a clock register
+		if value >= rtcSeconds {
+			m.ramBank = int(value)
+			return
+		}
+
+		m.ramBank = int(value & 0x7)
+
+	case addr < mbc3LatchRegister:
+		if m.rtc != nil && m.latch == 0x00 && value == 0x01 {
+			m.rtc.Latch()
+		}
+
+		m.latch = value
 	}
 }
 
 func (m *MBC3) WriteRAM(addr uint16, value byte) {
-	if m.ramEnabled {
-		offset := uint32(m.ramBank*ramBankSize) - ramOffset
-		m.ram[uint32(addr)+offset] = value
+	if !m.ramEnabled {
+		return
 	}
+
+	if m.ramBank >= rtcSeconds {
+		if m.rtc != nil {
+			m.rtc.Write(m.ramBank, value)
+			m.setDirty(true)
+		}
+
+		return
+	}
+
+	m.setDirty(writeBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset, value))
+}
+
+// Tick advances the real time clock when it is driven by emulated time.
+func (m *MBC3) Tick(cycles int) {
+	if m.rtc != nil {
+		m.rtc.Tick(cycles)
+	}
+}
+
+// SaveData implements Battery.
+// The clock registers are appended to the ram in the same layout other emulators use.
+func (m *MBC3) SaveData() []byte {
+	data := append([]byte(nil), m.ram...)
+	if m.rtc == nil {
+		return data
+	}
+
+	clock, _ := m.rtc.MarshalBinary()
+
+	return append(data, clock...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MBC3) LoadSaveData(data []byte) error {
+	// the clock footer is never a multiple of 1KB so whatever is left over
+	// after the ram is the footer
+	footerSize := len(data) % 0x400
+	copy(m.ram, data[:len(data)-footerSize])
+
+	if m.rtc == nil || footerSize == 0 {
+		return nil
+	}
+
+	return m.rtc.UnmarshalBinary(data[len(data)-footerSize:])
 }
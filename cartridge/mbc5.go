@@ -0,0 +1,99 @@
+package cartridge
+
+const (
+	mbc5ROMBankLowRegister  = 0x3000
+	mbc5ROMBankHighRegister = 0x4000
+	mbc5RAMBankRegister     = 0x6000
+
+	mbc5RumbleBit = 3
+)
+
+// MBC5 supports up to 8MB of ROM through a 9 bit bank number and up to 128KB
+// of RAM across 16 banks. Unlike MBC1 and MBC3, bank 0 can be mapped into the
+// switchable ROM area.
+type MBC5 struct {
+	rom     []byte
+	romBank int
+
+	ram        []byte
+	ramBank    int
+	ramEnabled bool
+
+	// hasRumble is set for cartridges with a rumble motor, these use bit 3 of
+	// the RAM bank register to drive the motor instead of selecting a bank
+	hasRumble bool
+	rumble    bool
+
+	dirtyFlag
+}
+
+func NewMBC5(rom []byte, ramSize int, hasRumble bool) *MBC5 {
+	return &MBC5{
+		rom:       rom,
+		ram:       make([]byte, ramSize),
+		romBank:   1,
+		hasRumble: hasRumble,
+	}
+}
+
+// Read implements BankController.
+func (m *MBC5) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000: // fixed bank 0
+		return readBank(m.rom, 0, romBankSize, addr)
+	case addr < 0x8000: // variable rom bank
+		return readBank(m.rom, m.romBank, romBankSize, addr-romOffset)
+	case !m.ramEnabled: // ram is disabled
+		return 0xFF
+	default: // reading from the ram bank
+		return readBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset)
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *MBC5) WriteRAM(addr uint16, value byte) {
+	if m.ramEnabled {
+		m.setDirty(writeBank(m.ram, m.ramBank, ramBankSize, addr-ramOffset, value))
+	}
+}
+
+// WriteROM implements BankController.
+func (m *MBC5) WriteROM(addr uint16, value byte) {
+	switch {
+	case addr < mbc1RAMEnableRegister:
+		m.ramEnabled = (value & 0xF) == 0xA
+
+	case addr < mbc5ROMBankLowRegister:
+		// lower 8 bits of the rom bank number
+		m.romBank = (m.romBank & 0x100) | int(value)
+
+	case addr < mbc5ROMBankHighRegister:
+		// 9th bit of the rom bank number
+		m.romBank = (m.romBank & 0xFF) | int(value&0x1)<<8
+
+	case addr < mbc5RAMBankRegister:
+		if m.hasRumble {
+			m.rumble = value&(1<<mbc5RumbleBit) != 0
+			m.ramBank = int(value & 0x7)
+			return
+		}
+
+		m.ramBank = int(value & 0xF)
+	}
+}
+
+// Rumble reports whether the rumble motor is currently switched on.
+func (m *MBC5) Rumble() bool {
+	return m.rumble
+}
+
+// SaveData implements Battery.
+func (m *MBC5) SaveData() []byte {
+	return append([]byte(nil), m.ram...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MBC5) LoadSaveData(data []byte) error {
+	copy(m.ram, data)
+	return nil
+}
@@ -0,0 +1,269 @@
+package cartridge
+
+const (
+	mbc6RAMEnableRegister    = 0x0400
+	mbc6RAMBankARegister     = 0x0800
+	mbc6RAMBankBRegister     = 0x0C00
+	mbc6FlashEnableRegister  = 0x1000
+	mbc6FlashWriteRegister   = 0x2000
+	mbc6ROMBankARegister     = 0x2800
+	mbc6ROMSelectARegister   = 0x3000
+	mbc6ROMBankBRegister     = 0x3800
+	mbc6ROMSelectBRegister   = 0x4000
+	mbc6FlashSelect          = 0x08
+	mbc6ROMHalfBankSize      = 0x2000
+	mbc6RAMHalfBankSize      = 0x1000
+	mbc6FlashSize            = 0x100000
+	mbc6FlashSectorSize      = 0x20000
+	mbc6FlashCommandAddr1    = 0x5555
+	mbc6FlashCommandAddr2    = 0x2AAA
+	mbc6FlashCommandProgram  = 0xA0
+	mbc6FlashCommandErase    = 0x80
+	mbc6FlashCommandChip     = 0x10
+	mbc6FlashCommandSector   = 0x30
+	mbc6FlashCommandID       = 0x90
+	mbc6FlashCommandReset    = 0xF0
+	mbc6FlashManufacturerID  = 0xC2
+	mbc6FlashDeviceID        = 0x81
+	mbc6FlashUnlockSequence1 = 0xAA
+	mbc6FlashUnlockSequence2 = 0x55
+)
+
+// flashState tracks where the flash chip is in a command sequence.
+type flashState int
+
+const (
+	flashIdle flashState = iota
+	flashUnlocked1
+	flashUnlocked2
+	flashProgram
+	flashErase
+	flashEraseUnlocked1
+	flashEraseUnlocked2
+	flashID
+)
+
+// MBC6 is only used by Net de Get. It splits both the rom and ram areas into
+// two independently banked halves, each rom half can map either the rom or a
+// 1MB flash chip.
+type MBC6 struct {
+	rom   []byte
+	flash []byte
+	// romBank holds the 8KB bank of each rom half and flashSelect whether it
+	// is mapped to the flash
+	romBank     [2]int
+	flashSelect [2]bool
+
+	ram        []byte
+	ramBank    [2]int
+	ramEnabled bool
+
+	flashEnabled      bool
+	flashWriteEnabled bool
+	flashState        flashState
+
+	dirtyFlag
+}
+
+func NewMBC6(rom []byte, ramSize int) *MBC6 {
+	flash := make([]byte, mbc6FlashSize)
+	for i := range flash {
+		flash[i] = 0xFF
+	}
+
+	return &MBC6{
+		rom:   rom,
+		flash: flash,
+		ram:   make([]byte, ramSize),
+	}
+}
+
+// Read implements BankController.
+func (m *MBC6) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000: // fixed 16KB bank 0
+		return readBank(m.rom, 0, romBankSize, addr)
+	case addr < 0x8000:
+		half := int(addr-romOffset) / mbc6ROMHalfBankSize
+		offset := int(addr) % mbc6ROMHalfBankSize
+
+		if !m.flashSelect[half] {
+			return readBank(m.rom, m.romBank[half], mbc6ROMHalfBankSize, uint16(offset))
+		}
+
+		if !m.flashEnabled {
+			return 0xFF
+		}
+
+		if m.flashState == flashID {
+			return m.flashID(offset)
+		}
+
+		return m.flash[m.flashIndex(half, offset)]
+	case !m.ramEnabled:
+		return 0xFF
+	default:
+		half, offset := m.ramHalf(addr)
+		return readBank(m.ram, m.ramBank[half], mbc6RAMHalfBankSize, offset)
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *MBC6) WriteRAM(addr uint16, value byte) {
+	if m.ramEnabled {
+		half, offset := m.ramHalf(addr)
+		m.setDirty(writeBank(m.ram, m.ramBank[half], mbc6RAMHalfBankSize, offset, value))
+	}
+}
+
+// WriteROM implements BankController.
+func (m *MBC6) WriteROM(addr uint16, value byte) {
+	switch {
+	case addr < mbc6RAMEnableRegister:
+		m.ramEnabled = value&0xF == 0xA
+	case addr < mbc6RAMBankARegister:
+		m.ramBank[0] = int(value & 0x7)
+	case addr < mbc6RAMBankBRegister:
+		m.ramBank[1] = int(value & 0x7)
+	case addr < mbc6FlashEnableRegister:
+		m.flashEnabled = value&0x1 == 1
+	case addr < mbc6FlashWriteRegister:
+		m.flashWriteEnabled = value&0x1 == 1
+	case addr < mbc6ROMBankARegister:
+		m.romBank[0] = int(value & 0x7F)
+	case addr < mbc6ROMSelectARegister:
+		m.flashSelect[0] = value == mbc6FlashSelect
+	case addr < mbc6ROMBankBRegister:
+		m.romBank[1] = int(value & 0x7F)
+	case addr < mbc6ROMSelectBRegister:
+		m.flashSelect[1] = value == mbc6FlashSelect
+	default:
+		// writes to the banked area are commands for the flash chip
+		half := int(addr-romOffset) / mbc6ROMHalfBankSize
+		if m.flashSelect[half] && m.flashEnabled {
+			m.writeFlash(half, int(addr)%mbc6ROMHalfBankSize, value)
+		}
+	}
+}
+
+// writeFlash steps the flash command state machine. Commands are unlocked by
+// writing 0xAA to 0x5555 and 0x55 to 0x2AAA in the flash address space.
+func (m *MBC6) writeFlash(half, offset int, value byte) {
+	if value == mbc6FlashCommandReset {
+		m.flashState = flashIdle
+		return
+	}
+
+	// the command addresses are relative to the start of the flash
+	addr := m.flashIndex(half, offset) & 0x7FFF
+
+	switch m.flashState {
+	case flashIdle, flashID:
+		if addr == mbc6FlashCommandAddr1 && value == mbc6FlashUnlockSequence1 {
+			m.flashState = flashUnlocked1
+			return
+		}
+
+		m.flashState = flashIdle
+
+	case flashUnlocked1:
+		m.flashState = flashIdle
+		if addr == mbc6FlashCommandAddr2 && value == mbc6FlashUnlockSequence2 {
+			m.flashState = flashUnlocked2
+		}
+
+	case flashUnlocked2:
+		m.flashState = flashIdle
+		if addr != mbc6FlashCommandAddr1 {
+			return
+		}
+
+		switch value {
+		case mbc6FlashCommandProgram:
+			m.flashState = flashProgram
+		case mbc6FlashCommandErase:
+			m.flashState = flashErase
+		case mbc6FlashCommandID:
+			m.flashState = flashID
+		}
+
+	case flashProgram:
+		// programming can only clear bits, erasing sets them again
+		if m.flashWriteEnabled {
+			m.flash[m.flashIndex(half, offset)] &= value
+			m.setDirty(true)
+		}
+
+		m.flashState = flashIdle
+
+	case flashErase:
+		m.flashState = flashIdle
+		if addr == mbc6FlashCommandAddr1 && value == mbc6FlashUnlockSequence1 {
+			m.flashState = flashEraseUnlocked1
+		}
+
+	case flashEraseUnlocked1:
+		m.flashState = flashIdle
+		if addr == mbc6FlashCommandAddr2 && value == mbc6FlashUnlockSequence2 {
+			m.flashState = flashEraseUnlocked2
+		}
+
+	case flashEraseUnlocked2:
+		m.flashState = flashIdle
+		if !m.flashWriteEnabled {
+			return
+		}
+
+		switch {
+		case value == mbc6FlashCommandChip && addr == mbc6FlashCommandAddr1:
+			fill(m.flash, 0xFF)
+			m.setDirty(true)
+		case value == mbc6FlashCommandSector:
+			start := m.flashIndex(half, offset) / mbc6FlashSectorSize * mbc6FlashSectorSize
+			fill(m.flash[start:start+mbc6FlashSectorSize], 0xFF)
+			m.setDirty(true)
+		}
+	}
+}
+
+// flashID returns the chip identification read back in id mode.
+func (m *MBC6) flashID(offset int) byte {
+	switch offset {
+	case 0:
+		return mbc6FlashManufacturerID
+	case 1:
+		return mbc6FlashDeviceID
+	default:
+		return 0x00
+	}
+}
+
+func (m *MBC6) flashIndex(half, offset int) int {
+	return bankIndex(m.romBank[half], mbc6ROMHalfBankSize, uint16(offset), len(m.flash))
+}
+
+// ramHalf returns which half of the ram area addr is in and its offset in that half.
+func (m *MBC6) ramHalf(addr uint16) (int, uint16) {
+	return int(addr-ramOffset) / mbc6RAMHalfBankSize, addr % mbc6RAMHalfBankSize
+}
+
+// SaveData implements Battery.
+// The flash is written after the ram as both keep their contents without power.
+func (m *MBC6) SaveData() []byte {
+	data := append([]byte(nil), m.ram...)
+	return append(data, m.flash...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MBC6) LoadSaveData(data []byte) error {
+	n := copy(m.ram, data)
+	copy(m.flash, data[n:])
+
+	return nil
+}
+
+func fill(b []byte, v byte) {
+	for i := range b {
+		b[i] = v
+	}
+}
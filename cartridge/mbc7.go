@@ -0,0 +1,162 @@
+package cartridge
+
+const (
+	mbc7RAMEnable2Register = 0x6000
+	mbc7RAMEnable2Value    = 0x40
+	// the registers are only mapped in the first half of the ram area
+	mbc7RegisterEnd = 0xB000
+
+	mbc7RegisterEraseLatch = 0x0
+	mbc7RegisterLatch      = 0x1
+	mbc7RegisterXLow       = 0x2
+	mbc7RegisterXHigh      = 0x3
+	mbc7RegisterYLow       = 0x4
+	mbc7RegisterYHigh      = 0x5
+	mbc7RegisterZero       = 0x6
+	mbc7RegisterOne        = 0x7
+	mbc7RegisterEEPROM     = 0x8
+
+	mbc7EraseValue = 0x55
+	mbc7LatchValue = 0xAA
+
+	// accelerometer readings are centred on accelCentre and move by about
+	// accelGravity for one g of tilt
+	accelCentre  = 0x81D0
+	accelGravity = 0x70
+	accelErased  = 0x8000
+)
+
+// MBC7 is used by Kirby Tilt 'n' Tumble and Command Master. It has an
+// accelerometer and a 93LC56 serial eeprom instead of ram.
+type MBC7 struct {
+	rom     []byte
+	romBank int
+
+	// ram must be enabled through both enable registers
+	ramEnabled1 bool
+	ramEnabled2 bool
+
+	// tiltX and tiltY are the current tilt in g, positive x is tilting
+	// right and positive y is tilting towards the player
+	tiltX float64
+	tiltY float64
+	// latchX and latchY are the accelerometer values read by the game
+	latchX uint16
+	latchY uint16
+	erased bool
+
+	eeprom *EEPROM
+}
+
+func NewMBC7(rom []byte) *MBC7 {
+	return &MBC7{
+		rom:     rom,
+		romBank: 1,
+		latchX:  accelErased,
+		latchY:  accelErased,
+		eeprom:  NewEEPROM(),
+	}
+}
+
+// Read implements BankController.
+func (m *MBC7) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000: // fixed bank 0
+		return readBank(m.rom, 0, romBankSize, addr)
+	case addr < 0x8000: // variable rom bank
+		return readBank(m.rom, m.romBank, romBankSize, addr-romOffset)
+	case !m.ramEnabled1 || !m.ramEnabled2 || addr >= mbc7RegisterEnd:
+		return 0xFF
+	}
+
+	switch addr >> 4 & 0xF {
+	case mbc7RegisterXLow:
+		return byte(m.latchX)
+	case mbc7RegisterXHigh:
+		return byte(m.latchX >> 8)
+	case mbc7RegisterYLow:
+		return byte(m.latchY)
+	case mbc7RegisterYHigh:
+		return byte(m.latchY >> 8)
+	case mbc7RegisterZero:
+		// the z axis is not connected
+		return 0x00
+	case mbc7RegisterEEPROM:
+		return m.eeprom.Read()
+	default:
+		return 0xFF
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *MBC7) WriteRAM(addr uint16, value byte) {
+	if !m.ramEnabled1 || !m.ramEnabled2 || addr >= mbc7RegisterEnd {
+		return
+	}
+
+	switch addr >> 4 & 0xF {
+	case mbc7RegisterEraseLatch:
+		if value == mbc7EraseValue {
+			m.erased = true
+			m.latchX = accelErased
+			m.latchY = accelErased
+		}
+	case mbc7RegisterLatch:
+		// the values can only be latched after they have been erased
+		if value == mbc7LatchValue && m.erased {
+			m.erased = false
+			m.latchX = accelValue(m.tiltX)
+			m.latchY = accelValue(m.tiltY)
+		}
+	case mbc7RegisterEEPROM:
+		m.eeprom.Write(value)
+	}
+}
+
+// WriteROM implements BankController.
+func (m *MBC7) WriteROM(addr uint16, value byte) {
+	switch {
+	case addr < mbc1RAMEnableRegister:
+		m.ramEnabled1 = value&0xF == 0xA
+		if !m.ramEnabled1 {
+			m.ramEnabled2 = false
+		}
+
+	case addr < mbc1ROMBankRegister:
+		m.romBank = int(value & 0x7F)
+
+	case addr < mbc7RAMEnable2Register:
+		// the second enable only takes effect while the first is set
+		if m.ramEnabled1 {
+			m.ramEnabled2 = value == mbc7RAMEnable2Value
+		}
+	}
+}
+
+// SetTilt sets the current tilt of the cartridge in g on each axis.
+func (m *MBC7) SetTilt(x, y float64) {
+	m.tiltX = x
+	m.tiltY = y
+}
+
+// Dirty reports whether the eeprom has changed since it was last called.
+func (m *MBC7) Dirty() bool {
+	return m.eeprom.Dirty()
+}
+
+// SaveData implements Battery.
+func (m *MBC7) SaveData() []byte {
+	return append([]byte(nil), m.eeprom.data[:]...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MBC7) LoadSaveData(data []byte) error {
+	copy(m.eeprom.data[:], data)
+	return nil
+}
+
+func accelValue(g float64) uint16 {
+	// clamp to the range the accelerometer can measure
+	g = max(-2, min(2, g))
+	return uint16(accelCentre + int(g*accelGravity))
+}
@@ -0,0 +1,165 @@
+package cartridge
+
+import "bytes"
+
+// mmm01MenuSize is the size of the menu at the end of the rom
+const mmm01MenuSize = 0x8000
+
+// MMM01 is the bank controller used by multicart compilations. At power on it
+// is unmapped and the last 32KB of the rom, which holds the game select menu,
+// is mapped into 0x0000-0x7FFF. The menu then writes the location of the
+// chosen game into the registers and sets the map enable bit, after which the
+// game only sees its own banks and behaves as if it were on an MBC1.
+type MMM01 struct {
+	rom []byte
+	ram []byte
+
+	// mapped is set once the menu has selected a game, after this the outer
+	// bank bits and masks are locked
+	mapped     bool
+	ramEnabled bool
+	mode       bool
+
+	// romLow is the 5 bit bank number the game sees, romOuter is the upper
+	// bank bits selected by the menu
+	romLow   byte
+	romOuter int
+	// romMask marks the bits of romLow which are fixed by the menu
+	romMask byte
+
+	ramLow   byte
+	ramOuter int
+	// ramMask marks the bits of ramLow which are fixed by the menu
+	ramMask byte
+
+	dirtyFlag
+}
+
+func NewMMM01(rom []byte, ramSize int) *MMM01 {
+	return &MMM01{
+		rom:    rom,
+		ram:    make([]byte, ramSize),
+		romLow: 1,
+	}
+}
+
+// Read implements BankController.
+func (m *MMM01) Read(addr uint16) byte {
+	switch {
+	case addr < 0x4000:
+		return readBank(m.rom, m.lowBank(), romBankSize, addr)
+	case addr < 0x8000:
+		return readBank(m.rom, m.highBank(), romBankSize, addr-romOffset)
+	case !m.ramEnabled:
+		return 0xFF
+	default:
+		return readBank(m.ram, m.ramBank(), ramBankSize, addr-ramOffset)
+	}
+}
+
+// WriteRAM implements BankController.
+func (m *MMM01) WriteRAM(addr uint16, value byte) {
+	if m.ramEnabled {
+		m.setDirty(writeBank(m.ram, m.ramBank(), ramBankSize, addr-ramOffset, value))
+	}
+}
+
+// WriteROM implements BankController.
+func (m *MMM01) WriteROM(addr uint16, value byte) {
+	switch {
+	case addr < 0x2000:
+		m.ramEnabled = value&0xF == 0xA
+
+		if !m.mapped {
+			m.ramMask = value >> 4 & 0x3
+			m.mapped = value&0x40 != 0
+		}
+
+	case addr < 0x4000:
+		// the menu fixes the masked bits, the game can only change the rest
+		m.romLow = m.romLow&m.romMask | value&^m.romMask&0x1F
+
+		if !m.mapped {
+			m.romOuter = m.romOuter&^0x60 | int(value&0x60)
+		}
+
+	case addr < 0x6000:
+		m.ramLow = m.ramLow&m.ramMask | value&^m.ramMask&0x3
+
+		if !m.mapped {
+			m.ramOuter = int(value >> 2 & 0x3)
+			m.romOuter = m.romOuter&0x60 | int(value>>4&0x3)<<7
+		}
+
+	case addr < 0x8000:
+		m.mode = value&0x1 == 1
+
+		if !m.mapped {
+			// the mask covers bits 1-4 of the low rom bank
+			m.romMask = value >> 1 & 0x1E
+		}
+	}
+}
+
+// lowBank returns the rom bank mapped at 0x0000-0x3FFF.
+func (m *MMM01) lowBank() int {
+	if !m.mapped {
+		// the menu lives in the last two banks of the rom
+		return (len(m.rom) - mmm01MenuSize) / romBankSize
+	}
+
+	// bank 0 of the game is the first bank of its region
+	return m.romOuter | int(m.romLow&m.romMask)
+}
+
+// highBank returns the rom bank mapped at 0x4000-0x7FFF.
+func (m *MMM01) highBank() int {
+	if !m.mapped {
+		return len(m.rom)/romBankSize - 1
+	}
+
+	low := m.romLow
+	// as on MBC1 the unmasked bits being zero selects the next bank
+	if low&^m.romMask == 0 {
+		low |= 1
+	}
+
+	return m.romOuter | int(low)
+}
+
+// ramBank returns the selected ram bank, as on MBC1 the game only banks ram in mode 1.
+func (m *MMM01) ramBank() int {
+	low := m.ramLow & m.ramMask
+	if m.mode || !m.mapped {
+		low = m.ramLow
+	}
+
+	return m.ramOuter<<2 | int(low)
+}
+
+// SaveData implements Battery.
+func (m *MMM01) SaveData() []byte {
+	return append([]byte(nil), m.ram...)
+}
+
+// LoadSaveData implements Battery.
+func (m *MMM01) LoadSaveData(data []byte) error {
+	copy(m.ram, data)
+	return nil
+}
+
+// hasMMM01Menu reports whether there is an MMM01 menu at the end of the rom.
+// The menu must have a valid header, so that game code which happens to sit
+// at the same place is not mistaken for one.
+func hasMMM01Menu(rom []byte) bool {
+	if len(rom) <= mmm01MenuSize {
+		return false
+	}
+
+	menu := rom[len(rom)-mmm01MenuSize:]
+	cartType := menu[cartTypeAddr]
+
+	return cartType >= 0x0B && cartType <= 0x0D &&
+		headerChecksum(menu) == menu[headerChecksumAddr] &&
+		bytes.Equal(menu[logoStart:logoEnd], rom[logoStart:logoEnd])
+}
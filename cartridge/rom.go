@@ -14,8 +14,13 @@ func NewROM(rom []byte) *ROM {
 }
 
 // Read implements BankController.
+// There is no RAM so reads from the RAM area return 0xFF
 func (r *ROM) Read(addr uint16) byte {
-	return r.rom[addr]
+	if addr >= 0x8000 {
+		return 0xFF
+	}
+
+	return readBank(r.rom, 0, len(r.rom), addr)
 }
 
 // WriteRAM implements BankController.
@@ -0,0 +1,300 @@
+package cartridge
+
+import (
+	"encoding/binary"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	rtcSeconds  = 0x08
+	rtcMinutes  = 0x09
+	rtcHours    = 0x0A
+	rtcDayLow   = 0x0B
+	rtcDayHigh  = 0x0C
+	rtcHaltBit  = 6
+	rtcCarryBit = 7
+
+	// cyclesPerSecond is the number of cpu cycles in one second of emulated time
+	cyclesPerSecond = 4194304
+
+	// rtcSaveSize is the size of the clock footer appended to the save ram,
+	// this is the layout used by BGB and VBA so saves can be shared
+	rtcSaveSize = 48
+	// rtcSaveSizeShort is an older variant of the footer with a 32 bit timestamp
+	rtcSaveSizeShort = 44
+)
+
+// ClockSource selects what drives the cartridge real time clock.
+type ClockSource int
+
+const (
+	// ClockHost advances the clock with the host wall clock, time keeps passing
+	// while the emulator is paused or closed.
+	ClockHost ClockSource = iota
+	// ClockEmulated advances the clock with the number of cycles the cpu has run.
+	ClockEmulated
+)
+
+var clockSourceNames = map[ClockSource]string{
+	ClockHost:     "host",
+	ClockEmulated: "emulated",
+}
+
+func (s ClockSource) String() string {
+	if name, ok := clockSourceNames[s]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Set implements flag.Value.
+func (s *ClockSource) Set(name string) error {
+	for source, n := range clockSourceNames {
+		if strings.EqualFold(n, name) {
+			*s = source
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown clock source: %s", name)
+}
+
+// RTC is the real time clock found in MBC3 cartridges such as Pokemon Gold.
+type RTC struct {
+	source ClockSource
+
+	seconds byte
+	minutes byte
+	hours   byte
+	days    uint16
+	halted  bool
+	carry   bool
+
+	// latched holds the register values copied by the latch sequence, these
+	// are the values the game reads back
+	latched [5]byte
+
+	// cycles counts emulated cycles towards the next second
+	cycles int
+	// lastSync is the host time the clock was last brought up to date
+	lastSync time.Time
+}
+
+func NewRTC(source ClockSource) *RTC {
+	return &RTC{
+		source:   source,
+		lastSync: time.Now(),
+	}
+}
+
+// Tick advances the clock by the given number of cpu cycles when it is driven by emulated time.
+func (r *RTC) Tick(cycles int) {
+	if r.source != ClockEmulated || r.halted {
+		return
+	}
+
+	r.cycles += cycles
+	for r.cycles >= cyclesPerSecond {
+		r.cycles -= cyclesPerSecond
+		r.advance(1)
+	}
+}
+
+// sync brings the clock up to date with the host time.
+func (r *RTC) sync() {
+	now := time.Now()
+	if r.source != ClockHost {
+		r.lastSync = now
+		return
+	}
+
+	elapsed := int64(now.Sub(r.lastSync) / time.Second)
+	if elapsed < 0 {
+		// the host clock went backwards, start counting again from now
+		r.lastSync = now
+		return
+	}
+
+	if elapsed == 0 {
+		return
+	}
+
+	// only move forward by whole seconds so the remainder is not lost
+	r.lastSync = r.lastSync.Add(time.Duration(elapsed) * time.Second)
+
+	if !r.halted {
+		r.advance(elapsed)
+	}
+}
+
+// advance moves the clock forward by the given number of seconds.
+func (r *RTC) advance(secs int64) {
+	// registers can be written with out of range values, in that case step a
+	// second at a time so the counters overflow the same way the hardware does
+	if r.seconds >= 60 || r.minutes >= 60 || r.hours >= 24 {
+		for ; secs > 0; secs-- {
+			r.tick()
+		}
+
+		return
+	}
+
+	total := int64(r.days)*86400 + int64(r.hours)*3600 + int64(r.minutes)*60 + int64(r.seconds) + secs
+
+	r.seconds = byte(total % 60)
+	r.minutes = byte(total / 60 % 60)
+	r.hours = byte(total / 3600 % 24)
+
+	days := total / 86400
+	if days > 0x1FF {
+		r.carry = true
+	}
+
+	r.days = uint16(days & 0x1FF)
+}
+
+// tick advances the clock by a single second.
+func (r *RTC) tick() {
+	r.seconds = (r.seconds + 1) & 0x3F
+	if r.seconds != 60 {
+		return
+	}
+
+	r.seconds = 0
+	r.minutes = (r.minutes + 1) & 0x3F
+	if r.minutes != 60 {
+		return
+	}
+
+	r.minutes = 0
+	r.hours = (r.hours + 1) & 0x1F
+	if r.hours != 24 {
+		return
+	}
+
+	r.hours = 0
+	r.days++
+	if r.days > 0x1FF {
+		r.days = 0
+		r.carry = true
+	}
+}
+
+// Latch copies the current clock registers into the latched registers.
+func (r *RTC) Latch() {
+	r.sync()
+	r.latched = r.registers()
+}
+
+func (r *RTC) registers() [5]byte {
+	dh := byte(r.days>>8) & 0x1
+	if r.halted {
+		dh |= 1 << rtcHaltBit
+	}
+
+	if r.carry {
+		dh |= 1 << rtcCarryBit
+	}
+
+	return [5]byte{r.seconds, r.minutes, r.hours, byte(r.days), dh}
+}
+
+// Read returns the latched value of the selected clock register.
+func (r *RTC) Read(reg int) byte {
+	switch reg {
+	case rtcSeconds, rtcMinutes:
+		return r.latched[reg-rtcSeconds] | 0xC0
+	case rtcHours:
+		return r.latched[reg-rtcSeconds] | 0xE0
+	case rtcDayLow:
+		return r.latched[reg-rtcSeconds]
+	case rtcDayHigh:
+		return r.latched[reg-rtcSeconds] | 0x3E
+	default:
+		return 0xFF
+	}
+}
+
+// Write sets the selected clock register.
+func (r *RTC) Write(reg int, value byte) {
+	r.sync()
+
+	switch reg {
+	case rtcSeconds:
+		r.seconds = value & 0x3F
+		// writing the seconds resets the sub second counter
+		r.cycles = 0
+	case rtcMinutes:
+		r.minutes = value & 0x3F
+	case rtcHours:
+		r.hours = value & 0x1F
+	case rtcDayLow:
+		r.days = r.days&0x100 | uint16(value)
+	case rtcDayHigh:
+		r.days = r.days&0xFF | uint16(value&0x1)<<8
+		r.halted = value&(1<<rtcHaltBit) != 0
+		r.carry = value&(1<<rtcCarryBit) != 0
+	default:
+		return
+	}
+
+	r.latched[reg-rtcSeconds] = r.registers()[reg-rtcSeconds]
+}
+
+// MarshalBinary encodes the clock in the 48 byte footer format used by other emulators.
+func (r *RTC) MarshalBinary() ([]byte, error) {
+	r.sync()
+
+	data := make([]byte, rtcSaveSize)
+	for i, v := range r.registers() {
+		binary.LittleEndian.PutUint32(data[i*4:], uint32(v))
+	}
+
+	for i, v := range r.latched {
+		binary.LittleEndian.PutUint32(data[20+i*4:], uint32(v))
+	}
+
+	binary.LittleEndian.PutUint64(data[40:], uint64(r.lastSync.Unix()))
+
+	return data, nil
+}
+
+// UnmarshalBinary restores the clock from a save footer, in host mode the time
+// which passed since the save was written is added to the clock.
+func (r *RTC) UnmarshalBinary(data []byte) error {
+	if len(data) != rtcSaveSize && len(data) != rtcSaveSizeShort {
+		return fmt.Errorf("invalid rtc save size: %d", len(data))
+	}
+
+	var regs [5]byte
+	for i := range regs {
+		regs[i] = byte(binary.LittleEndian.Uint32(data[i*4:]))
+	}
+
+	for i := range r.latched {
+		r.latched[i] = byte(binary.LittleEndian.Uint32(data[20+i*4:]))
+	}
+
+	var saved int64
+	if len(data) == rtcSaveSize {
+		saved = int64(binary.LittleEndian.Uint64(data[40:]))
+	} else {
+		saved = int64(binary.LittleEndian.Uint32(data[40:]))
+	}
+
+	r.seconds = regs[0] & 0x3F
+	r.minutes = regs[1] & 0x3F
+	r.hours = regs[2] & 0x1F
+	r.days = uint16(regs[4]&0x1)<<8 | uint16(regs[3])
+	r.halted = regs[4]&(1<<rtcHaltBit) != 0
+	r.carry = regs[4]&(1<<rtcCarryBit) != 0
+	r.cycles = 0
+
+	r.lastSync = time.Unix(saved, 0)
+	r.sync()
+
+	return nil
+}
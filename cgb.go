@@ -0,0 +1,260 @@
+package main
+
+const (
+	// CGB registers
+	KEY0  uint16 = 0xFF4C // CGB mode select, only writable by the boot rom
+	KEY1  uint16 = 0xFF4D // Speed switch
+	VBK   uint16 = 0xFF4F // VRAM bank
+	HDMA1 uint16 = 0xFF51 // HDMA source high
+	HDMA2 uint16 = 0xFF52 // HDMA source low
+	HDMA3 uint16 = 0xFF53 // HDMA destination high
+	HDMA4 uint16 = 0xFF54 // HDMA destination low
+	HDMA5 uint16 = 0xFF55 // HDMA length, mode and start
+	BCPS  uint16 = 0xFF68 // Background palette index
+	BCPD  uint16 = 0xFF69 // Background palette data
+	OCPS  uint16 = 0xFF6A // Object palette index
+	OCPD  uint16 = 0xFF6B // Object palette data
+	SVBK  uint16 = 0xFF70 // WRAM bank
+
+	// key0DMGMode is set in KEY0 by the boot rom to run a DMG game
+	key0DMGMode = 2
+
+	// hdmaBlockSize is the number of bytes copied by each HBlank transfer
+	hdmaBlockSize = 0x10
+	// hdmaBlockCycles is how long the cpu is stopped for each block in single speed
+	hdmaBlockCycles = 32
+)
+
+// colourPalettes is the CGB palette memory for either the background or the
+// objects. It holds 8 palettes of 4 colours, each colour is 15 bit RGB.
+type colourPalettes struct {
+	data [64]byte
+	// index selects the byte accessed through the data register, when bit 7
+	// is set it is incremented after each write
+	index byte
+}
+
+func (c *colourPalettes) readIndex() byte {
+	return c.index | 0x40
+}
+
+func (c *colourPalettes) writeIndex(val byte) {
+	c.index = val & 0xBF
+}
+
+func (c *colourPalettes) readData() byte {
+	return c.data[c.index&0x3F]
+}
+
+func (c *colourPalettes) writeData(val byte) {
+	c.data[c.index&0x3F] = val
+
+	if TestBit(c.index, 7) {
+		c.index = 0x80 | (c.index+1)&0x3F
+	}
+}
+
+// setColour sets a colour in a palette from its 15 bit value.
+func (c *colourPalettes) setColour(palette, colourID byte, rgb uint16) {
+	i := palette*8 + colourID*2
+	c.data[i] = byte(rgb)
+	c.data[i+1] = byte(rgb >> 8)
+}
+
+// colour returns the screen colour of a colour id in a palette.
+func (c *colourPalettes) colour(palette, colourID byte) (r, g, b byte) {
+	i := palette*8 + colourID*2
+	rgb := uint16(c.data[i]) | uint16(c.data[i+1])<<8
+
+	return scaleColour(rgb), scaleColour(rgb >> 5), scaleColour(rgb >> 10)
+}
+
+// scaleColour converts the lower 5 bits of v to an 8 bit colour channel.
+func scaleColour(v uint16) byte {
+	c := byte(v & 0x1F)
+	return c<<3 | c>>2
+}
+
+// compatibility palettes loaded for DMG games on CGB hardware when there is no
+// boot rom. The boot rom picks these per game from the title, without it every
+// game gets the palette the boot rom uses for games it does not recognise.
+var (
+	compatBGPalette  = [4]uint16{0x7FFF, 0x1BEF, 0x6180, 0x0000}
+	compatOBJPalette = [4]uint16{0x7FFF, 0x421F, 0x1CF2, 0x0000}
+)
+
+// hdma is the CGB transfer from ROM or RAM into VRAM. General purpose
+// transfers copy everything at once, HBlank transfers copy a block each HBlank.
+type hdma struct {
+	source uint16
+	dest   uint16
+	// length is the number of blocks left to copy minus one
+	length byte
+	// active is set while an HBlank transfer is running
+	active bool
+}
+
+// readCGB reads the CGB only io registers, ok is false for any other address.
+func (m *Memory) readCGB(addr uint16) (val byte, ok bool) {
+	switch addr {
+	case KEY1:
+		speed := byte(0)
+		if m.cpu.doubleSpeed {
+			speed = 0x80
+		}
+
+		return 0x7E | speed | m.io[KEY1-NotUsable]&0x1, true
+	case VBK:
+		return 0xFE | byte(m.vramBank), true
+	case HDMA1, HDMA2, HDMA3, HDMA4:
+		return 0xFF, true
+	case HDMA5:
+		if m.hdma.active {
+			return m.hdma.length, true
+		}
+
+		return 0x80 | m.hdma.length, true
+	case BCPS:
+		return m.bgPalettes.readIndex(), true
+	case BCPD:
+		return m.bgPalettes.readData(), true
+	case OCPS:
+		return m.objPalettes.readIndex(), true
+	case OCPD:
+		return m.objPalettes.readData(), true
+	case SVBK:
+		return 0xF8 | byte(m.wramBank), true
+	default:
+		return 0, false
+	}
+}
+
+// writeCGB writes the CGB only io registers, it returns false for any other address.
+func (m *Memory) writeCGB(addr uint16, val byte) bool {
+	switch addr {
+	case KEY0:
+		// the boot rom selects dmg mode before it is unmapped
+		if m.bootROMEnabled && TestBit(val, key0DMGMode) {
+			m.cgbMode = false
+		}
+	case KEY1:
+		m.io[KEY1-NotUsable] = val & 0x1
+	case VBK:
+		m.vramBank = int(val & 0x1)
+	case HDMA1:
+		m.hdma.source = uint16(val)<<8 | m.hdma.source&0xFF
+	case HDMA2:
+		m.hdma.source = m.hdma.source&0xFF00 | uint16(val&0xF0)
+	case HDMA3:
+		m.hdma.dest = uint16(val&0x1F)<<8 | m.hdma.dest&0xFF
+	case HDMA4:
+		m.hdma.dest = m.hdma.dest&0xFF00 | uint16(val&0xF0)
+	case HDMA5:
+		m.startHDMA(val)
+	case BCPS:
+		m.bgPalettes.writeIndex(val)
+	case BCPD:
+		m.bgPalettes.writeData(val)
+	case OCPS:
+		m.objPalettes.writeIndex(val)
+	case OCPD:
+		m.objPalettes.writeData(val)
+	case SVBK:
+		m.wramBank = max(int(val&0x7), 1)
+	default:
+		return false
+	}
+
+	return true
+}
+
+func (m *Memory) startHDMA(val byte) {
+	// writing with bit 7 clear stops a running HBlank transfer
+	if m.hdma.active && !TestBit(val, 7) {
+		m.hdma.active = false
+		return
+	}
+
+	m.hdma.length = val & 0x7F
+
+	if TestBit(val, 7) {
+		m.hdma.active = true
+		return
+	}
+
+	// general purpose transfers copy everything straight away
+	blocks := int(m.hdma.length) + 1
+	for i := 0; i < blocks; i++ {
+		m.copyHDMABlock()
+	}
+
+	m.stallCycles += blocks * m.hdmaBlockCycles()
+}
+
+// hblankDMA copies the next block of a running HBlank transfer, it is called
+// by the PPU as each HBlank starts.
+func (m *Memory) hblankDMA() {
+	if !m.hdma.active {
+		return
+	}
+
+	m.copyHDMABlock()
+	m.stallCycles += m.hdmaBlockCycles()
+
+	// the length wraps past zero once the last block is copied
+	if m.hdma.length == 0xFF {
+		m.hdma.active = false
+	}
+}
+
+// copyHDMABlock copies a single block into the current VRAM bank.
+func (m *Memory) copyHDMABlock() {
+	for i := uint16(0); i < hdmaBlockSize; i++ {
+		m.vram[m.vramBank][(m.hdma.dest+i)&0x1FFF] = m.read(m.hdma.source + i)
+	}
+
+	m.hdma.source += hdmaBlockSize
+	m.hdma.dest += hdmaBlockSize
+	m.hdma.length--
+}
+
+// hdmaBlockCycles returns how many cpu cycles a block takes, the transfer
+// runs at the same speed in double speed mode so it takes twice the cycles.
+func (m *Memory) hdmaBlockCycles() int {
+	if m.cpu.doubleSpeed {
+		return 2 * hdmaBlockCycles
+	}
+
+	return hdmaBlockCycles
+}
+
+// speedSwitchArmed reports whether a STOP instruction should switch speed.
+func (m *Memory) speedSwitchArmed() bool {
+	return m.cgbMode && TestBit(m.io[KEY1-NotUsable], 0)
+}
+
+// switchSpeed toggles double speed mode, it is called by STOP once armed.
+func (m *Memory) switchSpeed() {
+	m.cpu.doubleSpeed = !m.cpu.doubleSpeed
+	m.io[KEY1-NotUsable] = 0
+}
+
+// skipBootCGB sets up the palettes the CGB boot rom leaves behind.
+func (m *Memory) skipBootCGB() {
+	if m.cgbMode {
+		// colour games start with white background palettes
+		for p := byte(0); p < 8; p++ {
+			for c := byte(0); c < 4; c++ {
+				m.bgPalettes.setColour(p, c, 0x7FFF)
+			}
+		}
+
+		return
+	}
+
+	for c := byte(0); c < 4; c++ {
+		m.bgPalettes.setColour(0, c, compatBGPalette[c])
+		m.objPalettes.setColour(0, c, compatOBJPalette[c])
+		m.objPalettes.setColour(1, c, compatOBJPalette[c])
+	}
+}
@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestHBlankHDMA(t *testing.T) {
+	for _, blocks := range []int{1, 2, 16, 128} {
+		m := NewMemory(ModelCGB)
+		m.cpu = NewCPU(m)
+
+		for i := range m.wram[0] {
+			m.wram[0][i] = 0xAA
+		}
+
+		// copy from the start of WRAM to the start of VRAM
+		m.Write(HDMA1, 0xC0)
+		m.Write(HDMA2, 0x00)
+		m.Write(HDMA3, 0x00)
+		m.Write(HDMA4, 0x00)
+		m.Write(HDMA5, 0x80|byte(blocks-1))
+
+		// run through more HBlanks than the transfer needs
+		for i := 0; i < 0x100; i++ {
+			m.hblankDMA()
+		}
+
+		copied := 0
+		for _, b := range m.vram[0] {
+			if b == 0xAA {
+				copied++
+			}
+		}
+
+		if copied != blocks*hdmaBlockSize {
+			t.Errorf("%d blocks copied %d bytes, want %d", blocks, copied, blocks*hdmaBlockSize)
+		}
+
+		if got := m.Read(HDMA5); got != 0xFF {
+			t.Errorf("%d blocks: HDMA5 reads %#02x after the transfer, want 0xff", blocks, got)
+		}
+	}
+}
@@ -58,21 +58,36 @@ type CPU struct {
 
 	halted            bool
 	interruptsEnabled bool
+	// doubleSpeed is the CGB double speed mode, the cpu and timers run twice
+	// as fast as the rest of the hardware
+	doubleSpeed bool
 
 	dividerCounter int
 	timerCounter   int
 }
 
+// NewCPU returns the cpu in its power on state, ready to run the boot rom from 0x0000.
 func NewCPU(mem *Memory) *CPU {
 	return &CPU{
 		registers:    NewRegisters(),
 		memory:       mem,
-		pc:           0x0100,
-		sp:           0xFFFE,
 		timerCounter: 1024,
 	}
 }
 
+// SkipBoot sets the cpu to the state the boot rom of the model leaves it in,
+// so the game can be started at 0x0100 without running a boot rom.
+func (c *CPU) SkipBoot(model Model) {
+	s := postBootStates[model]
+
+	c.registers.setAF(s.af&0xFF00 | uint16(s.postBootFlags(model, c.memory.cart.Header().HeaderChecksum)))
+	c.registers.setBC(s.bc)
+	c.registers.setDE(s.de)
+	c.registers.setHL(s.hl)
+	c.pc = 0x0100
+	c.sp = 0xFFFE
+}
+
 // Update ticks the cpu, reading the next instruction and executing it
 func (c *CPU) Update() int {
 	var cycles int
@@ -90,6 +105,11 @@ func (c *CPU) Update() int {
 		cycles = 4
 	}
 
+	// hdma transfers stop the cpu while they copy
+	cycles += c.memory.stallCycles
+	c.memory.stallCycles = 0
+
+	c.memory.tickDMA(cycles)
 	c.updateTimers(cycles)
 	cycles += c.handleInterrupt()
 
@@ -103,8 +123,15 @@ func (c *CPU) execute(op byte, prefixed bool) uint16 {
 		switch op {
 		case 0x00: // NOP
 		case 0x10: // STOP
-			c.halted = true
 			c.readNext()
+
+			// on the CGB STOP is also used to switch speed once it has been armed
+			if c.memory.speedSwitchArmed() {
+				c.memory.switchSpeed()
+				break
+			}
+
+			c.halted = true
 		case 0x2F: // CPL
 			c.registers.a = ^c.registers.a
 			c.registers.f.Subtract = true
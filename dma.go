@@ -0,0 +1,99 @@
+package main
+
+const (
+	// DMA starts an OAM DMA transfer from the page written to it
+	DMA uint16 = 0xFF46
+
+	dmaLength = 0xA0
+	// dmaStartDelay is how many M-cycles pass between writing DMA and the first byte being copied
+	dmaStartDelay = 2
+)
+
+// oamDMA copies a page of memory to OAM one byte every M-cycle.
+type oamDMA struct {
+	// active is set while bytes are being copied, the cpu can only use HRAM
+	active bool
+	source uint16
+	index  int
+	// value is the last byte copied, which is what the cpu sees on the bus
+	value byte
+
+	// a transfer which has been started waits for delay M-cycles, a running
+	// transfer carries on until the new one takes over
+	pending      bool
+	pendingDelay int
+	pendingPage  byte
+	// written is set until the end of the instruction which wrote DMA. The
+	// cpu writes in the last M-cycle of an instruction so the earlier ones
+	// don't count towards the delay, but a running transfer carries on in them.
+	written bool
+
+	// cycles holds the T-cycles which don't yet make up a whole M-cycle
+	cycles int
+}
+
+// startDMA schedules a transfer from the page val, restarting any transfer in progress.
+func (m *Memory) startDMA(val byte) {
+	m.io[DMA-NotUsable] = val
+	m.dma.pending = true
+	m.dma.pendingDelay = dmaStartDelay
+	m.dma.pendingPage = val
+	m.dma.written = true
+}
+
+// tickDMA runs the transfer for the cycles of the instruction which has just run.
+func (m *Memory) tickDMA(cycles int) {
+	if !m.dma.active && !m.dma.pending {
+		return
+	}
+
+	written := m.dma.written
+	m.dma.written = false
+
+	m.dma.cycles += cycles
+	for ; m.dma.cycles >= 4; m.dma.cycles -= 4 {
+		if m.dma.pending && !written {
+			m.dma.pendingDelay--
+			if m.dma.pendingDelay == 0 {
+				m.dma.pending = false
+				m.dma.active = true
+				m.dma.source = dmaSource(m.dma.pendingPage)
+				m.dma.index = 0
+			}
+		}
+
+		if !m.dma.active {
+			continue
+		}
+
+		m.dma.value = m.read(m.dma.source + uint16(m.dma.index))
+		m.oam[m.dma.index] = m.dma.value
+		m.dma.index++
+
+		if m.dma.index == dmaLength {
+			m.dma.active = false
+		}
+	}
+
+	if !m.dma.active && !m.dma.pending {
+		m.dma.cycles = 0
+	}
+}
+
+// dmaSource returns the address a transfer from page starts at. Pages from
+// 0xE0 up read from WRAM like echo RAM does.
+func dmaSource(page byte) uint16 {
+	addr := uint16(page) << 8
+	if addr >= WRAM {
+		addr -= echoRAMOffset
+	}
+
+	return addr
+}
+
+// dmaConflict reports whether a cpu access to addr clashes with a running
+// transfer. The transfer owns the bus so only HRAM and the io registers,
+// which aren't on it, can be used.
+func (m *Memory) dmaConflict(addr uint16) bool {
+	return m.dma.active && addr < NotUsable
+}
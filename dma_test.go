@@ -0,0 +1,144 @@
+package main
+
+import "testing"
+
+// newDMATest returns a cpu which runs program from HRAM, the only memory it
+// can use while a transfer has the bus. Page 0xC0 holds 0x10 plus each offset
+// and page 0xC1 holds 0xFF minus each offset.
+func newDMATest(program ...byte) *CPU {
+	m := NewMemory(ModelDMG)
+	c := NewCPU(m)
+	m.cpu = c
+
+	for i := 0; i < 0x100; i++ {
+		m.wram[0][i] = byte(0x10 + i)
+		m.wram[0][0x100+i] = byte(0xFF - i)
+	}
+
+	// the program ends by jumping to itself
+	program = append(program, 0x18, 0xFE)
+	copy(m.hram[:], program)
+	c.pc = IO
+
+	return c
+}
+
+// finishDMA runs the cpu until the transfer is done.
+func finishDMA(t *testing.T, c *CPU) {
+	t.Helper()
+
+	for i := 0; c.memory.dma.active || c.memory.dma.pending; i++ {
+		if i > 1000 {
+			t.Fatal("transfer never finished")
+		}
+
+		c.Update()
+	}
+}
+
+func TestDMATiming(t *testing.T) {
+	// LDH (DMA),A then NOPs
+	c := newDMATest(0xE0, 0x46, 0x00, 0x00, 0x00)
+	c.registers.a = 0xC0
+	m := c.memory
+
+	c.Update()
+	if m.dma.active {
+		t.Fatal("transfer is active straight after the write")
+	}
+
+	// the first M-cycle after the write is the start delay
+	c.Update()
+	if m.dma.active || m.oam[0] != 0 {
+		t.Fatalf("transfer started one M-cycle after the write, oam[0] is %#02x", m.oam[0])
+	}
+
+	c.Update()
+	if !m.dma.active || m.dma.index != 1 || m.oam[0] != 0x10 {
+		t.Fatalf("after two M-cycles %d bytes are copied and oam[0] is %#02x, want 1 byte and 0x10", m.dma.index, m.oam[0])
+	}
+
+	finishDMA(t, c)
+
+	for i := 0; i < dmaLength; i++ {
+		if want := byte(0x10 + i); m.oam[i] != want {
+			t.Fatalf("oam[%d] is %#02x, want %#02x", i, m.oam[i], want)
+		}
+	}
+}
+
+func TestDMARestart(t *testing.T) {
+	program := []byte{0xE0, 0x46}
+	for i := 0; i < 10; i++ {
+		program = append(program, 0x00)
+	}
+
+	// LD A,0xC1 then LDH (DMA),A and two NOPs
+	program = append(program, 0x3E, 0xC1, 0xE0, 0x46, 0x00, 0x00)
+
+	c := newDMATest(program...)
+	c.registers.a = 0xC0
+	m := c.memory
+
+	// the first transfer has copied 14 bytes by the end of the second write
+	for i := 0; i < 13; i++ {
+		c.Update()
+	}
+
+	if m.dma.index != 14 || !m.dma.pending {
+		t.Fatalf("%d bytes copied when the transfer is restarted, want 14", m.dma.index)
+	}
+
+	// the old transfer carries on through the start delay
+	c.Update()
+	if m.dma.index != 15 || m.oam[14] != 0x10+14 {
+		t.Fatalf("old transfer stopped during the start delay, %d bytes copied", m.dma.index)
+	}
+
+	c.Update()
+	if m.dma.index != 1 || m.oam[0] != 0xFF {
+		t.Fatalf("new transfer didn't start from the beginning, index %d and oam[0] %#02x", m.dma.index, m.oam[0])
+	}
+
+	finishDMA(t, c)
+
+	for i := 0; i < dmaLength; i++ {
+		if want := byte(0xFF - i); m.oam[i] != want {
+			t.Fatalf("oam[%d] is %#02x, want %#02x", i, m.oam[i], want)
+		}
+	}
+}
+
+func TestDMABusConflict(t *testing.T) {
+	// LDH (DMA),A, three NOPs then LD A,(0xD000)
+	c := newDMATest(0xE0, 0x46, 0x00, 0x00, 0x00, 0xFA, 0x00, 0xD0)
+	c.registers.a = 0xC0
+	m := c.memory
+	m.wram[1][0] = 0x99
+
+	for i := 0; i < 5; i++ {
+		c.Update()
+	}
+
+	// the second byte was the last one copied before the load
+	if c.registers.a != 0x11 {
+		t.Errorf("cpu read %#02x from WRAM during the transfer, want the byte being copied 0x11", c.registers.a)
+	}
+
+	if got := m.Read(0xFE00); got != 0xFF {
+		t.Errorf("OAM reads %#02x during the transfer, want 0xff", got)
+	}
+
+	m.hram[0x10] = 0x42
+	if got := m.Read(IO + 0x10); got != 0x42 {
+		t.Errorf("HRAM reads %#02x during the transfer, want 0x42", got)
+	}
+
+	// writes to the bus are lost
+	m.Write(0xD000, 0x55)
+	finishDMA(t, c)
+
+	if got := m.Read(0xD000); got != 0x99 {
+		t.Errorf("WRAM is %#02x after a write during the transfer, want 0x99", got)
+	}
+}
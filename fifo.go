@@ -0,0 +1,415 @@
+package main
+
+const (
+	// fetchStartDelay is how many dots the fetcher spends on the tile fetch
+	// which is thrown away at the start of every line
+	fetchStartDelay = 6
+	// spriteFetchDots is how long the fetcher is paused to fetch a sprite
+	spriteFetchDots = 6
+	// maxLineSprites is how many sprites the OAM scan finds on a line
+	maxLineSprites = 10
+)
+
+// fifoPixel is a pixel waiting in one of the pixel FIFOs.
+type fifoPixel struct {
+	colour byte
+	// palette is the CGB palette number, or for DMG sprites which of OBP0 and OBP1 is used
+	palette byte
+	// priority is the BG priority bit of the tile or sprite attributes
+	priority bool
+	// oam is the OAM index of the sprite the pixel came from
+	oam int
+}
+
+// pixelFIFO is a queue of up to 16 pixels.
+type pixelFIFO struct {
+	pixels [16]fifoPixel
+	head   int
+	size   int
+}
+
+func (f *pixelFIFO) push(p fifoPixel) {
+	f.pixels[(f.head+f.size)%len(f.pixels)] = p
+	f.size++
+}
+
+func (f *pixelFIFO) pop() fifoPixel {
+	p := f.pixels[f.head]
+	f.head = (f.head + 1) % len(f.pixels)
+	f.size--
+
+	return p
+}
+
+// at returns the pixel i places from the front of the queue.
+func (f *pixelFIFO) at(i int) *fifoPixel {
+	return &f.pixels[(f.head+i)%len(f.pixels)]
+}
+
+func (f *pixelFIFO) clear() {
+	f.head = 0
+	f.size = 0
+}
+
+// oamSprite is a sprite the OAM scan found on the current line.
+type oamSprite struct {
+	y, x  int
+	tile  byte
+	flags byte
+	index int
+
+	fetched bool
+}
+
+// fifoRenderer draws a line a dot at a time like the real PPU. A background
+// fetcher fills the background FIFO with a tile every 6 dots while a pixel is
+// shifted out every dot, sprites pause the fetcher while they are merged into
+// the sprite FIFO. Registers are read as the line is drawn so mid line
+// changes show up, and the length of Mode3 changes with the fine scroll,
+// the window and the sprites on the line.
+type fifoRenderer struct {
+	p *PPU
+
+	bg  pixelFIFO
+	obj pixelFIFO
+
+	// fetcher state
+	step     int
+	tileX    int
+	fetchY   int
+	tileNum  byte
+	attr     byte
+	lo, hi   byte
+	inWindow bool
+
+	// lx is the x position of the next pixel to be drawn
+	lx int
+	// discard is how many pixels are thrown away for the fine scroll of SCX
+	discard int
+	// dots is how long Mode3 has been running on this line
+	dots  int
+	stall int
+
+	sprites     []oamSprite
+	spriteFetch int
+	sprite      *oamSprite
+
+	// windowUsed is set when the window is drawn on the line
+	windowUsed bool
+}
+
+func newFIFORenderer(p *PPU) *fifoRenderer {
+	return &fifoRenderer{
+		p: p,
+	}
+}
+
+// start sets up drawing the line, finding the sprites on it like the OAM scan.
+func (f *fifoRenderer) start(line int) {
+	mem := f.p.mem
+
+	f.bg.clear()
+	f.obj.clear()
+	f.step = 0
+	f.tileX = 0
+	f.inWindow = false
+	f.windowUsed = false
+	f.lx = 0
+	f.discard = int(mem.Read(SCX) & 0x7)
+	f.dots = 0
+	f.stall = fetchStartDelay
+	f.spriteFetch = 0
+	f.sprite = nil
+
+	f.sprites = f.p.scanOAM(line, f.p.spriteHeight(mem.Read(LCDC)))
+}
+
+// done reports whether the whole line has been drawn.
+func (f *fifoRenderer) done() bool {
+	return f.lx >= ScreenWidth
+}
+
+// finish is called at the end of Mode3.
+func (f *fifoRenderer) finish() {
+	if f.windowUsed {
+		f.p.windowLine++
+	}
+
+	f.p.windowWrap = f.windowUsed && f.p.mem.Read(WX) == 166
+}
+
+// tick runs the renderer for a single dot.
+func (f *fifoRenderer) tick() {
+	f.dots++
+
+	if f.stall > 0 {
+		f.stall--
+		return
+	}
+
+	if f.spriteFetch > 0 {
+		f.spriteFetch--
+		if f.spriteFetch == 0 {
+			f.fetchSprite(f.sprite)
+			f.sprite = nil
+		}
+
+		return
+	}
+
+	if s := f.nextSprite(); s != nil {
+		// the background fetcher has to reach its last step and have pixels
+		// to draw before the sprite is fetched, this costs up to 5 dots
+		if f.step < 5 || f.bg.size == 0 {
+			f.tickFetcher()
+			return
+		}
+
+		s.fetched = true
+		f.sprite = s
+		f.spriteFetch = spriteFetchDots - 1
+		return
+	}
+
+	// pixels pushed by the fetcher are shifted out from the next dot
+	f.shift()
+	f.tickFetcher()
+}
+
+// nextSprite returns the sprite which starts at the current x position, if any.
+// When several sprites start at once, which happens at the left edge of the
+// screen, the one with the lowest x is fetched first and then the one
+// earliest in OAM, so the DMG draw order holds.
+func (f *fifoRenderer) nextSprite() *oamSprite {
+	if !TestBit(f.p.mem.Read(LCDC), 1) {
+		return nil
+	}
+
+	var next *oamSprite
+	for i := range f.sprites {
+		s := &f.sprites[i]
+		if s.fetched || s.x > f.lx+8 {
+			continue
+		}
+
+		// the sprites are in OAM order so only a lower x replaces the current pick
+		if next == nil || s.x < next.x {
+			next = s
+		}
+	}
+
+	return next
+}
+
+// tickFetcher runs the background fetcher for a dot. Each of the tile number,
+// low byte and high byte take 2 dots, then the tile is pushed once the FIFO is empty.
+func (f *fifoRenderer) tickFetcher() {
+	switch f.step {
+	case 1:
+		f.fetchTile()
+	case 3:
+		f.lo = f.fetchData(0)
+	case 5:
+		f.hi = f.fetchData(1)
+	}
+
+	if f.step < 6 {
+		f.step++
+	}
+
+	if f.step < 6 || f.bg.size != 0 {
+		return
+	}
+
+	for i := byte(0); i < 8; i++ {
+		bit := 7 - i
+		if TestBit(f.attr, 5) {
+			bit = i
+		}
+
+		f.bg.push(fifoPixel{
+			colour:   toColourID(f.lo, f.hi, bit),
+			palette:  f.attr & 0x7,
+			priority: TestBit(f.attr, 7),
+		})
+	}
+
+	f.step = 0
+	f.tileX++
+}
+
+func (f *fifoRenderer) fetchTile() {
+	mem := f.p.mem
+	lcdc := mem.Read(LCDC)
+	mapAddr := f.p.getTileMapAddress(lcdc, f.inWindow)
+
+	var x int
+	if f.inWindow {
+		f.fetchY = f.p.windowLine
+		x = f.tileX
+	} else {
+		f.fetchY = (f.p.getLine() + int(mem.Read(SCY))) & 0xFF
+		x = (int(mem.Read(SCX))/8 + f.tileX) & 0x1F
+	}
+
+	addr := mapAddr + uint16(f.fetchY/8)*32 + uint16(x)
+	f.tileNum = mem.readVRAM(0, addr)
+
+	// the CGB keeps the attributes of each tile in the map in VRAM bank 1
+	f.attr = 0
+	if mem.cgbMode {
+		f.attr = mem.readVRAM(1, addr)
+	}
+}
+
+// fetchData reads the low or high byte of the current row of the tile.
+func (f *fifoRenderer) fetchData(half uint16) byte {
+	dataAddr := f.p.getTileDataAddress(f.p.mem.Read(LCDC))
+
+	var tileAddr uint16
+	if dataAddr == 0x9000 {
+		tileAddr = uint16(int32(dataAddr) + int32(int8(f.tileNum))*16)
+	} else {
+		tileAddr = dataAddr + uint16(f.tileNum)*16
+	}
+
+	row := f.fetchY % 8
+	if TestBit(f.attr, 6) {
+		row = 7 - row
+	}
+
+	return f.p.mem.readVRAM(int(f.attr>>3)&0x1, tileAddr+uint16(row*2)+half)
+}
+
+// fetchSprite merges the current line of the sprite into the sprite FIFO.
+func (f *fifoRenderer) fetchSprite(s *oamSprite) {
+	mem := f.p.mem
+
+	size := f.p.spriteHeight(mem.Read(LCDC))
+	tile := s.tile
+	if size == 16 {
+		tile &= 0xFE
+	}
+
+	line := f.p.getLine() + 16 - s.y
+	if TestBit(s.flags, 6) {
+		line = size - line - 1
+	}
+
+	bank := 0
+	palette := (s.flags >> 4) & 0x1
+	if mem.cgbMode {
+		bank = int(s.flags>>3) & 0x1
+		palette = s.flags & 0x7
+	}
+
+	addr := 0x8000 + uint16(tile)*16 + uint16(line*2)
+	lo := mem.readVRAM(bank, addr)
+	hi := mem.readVRAM(bank, addr+1)
+
+	// sprites which start off the left of the screen lose the pixels that are off screen
+	skip := 0
+	if s.x < 8 {
+		skip = 8 - s.x
+	}
+
+	for f.obj.size < 8-skip {
+		f.obj.push(fifoPixel{})
+	}
+
+	for i := skip; i < 8; i++ {
+		bit := byte(7 - i)
+		if TestBit(s.flags, 5) {
+			bit = byte(i)
+		}
+
+		px := fifoPixel{
+			colour:   toColourID(lo, hi, bit),
+			palette:  palette,
+			priority: TestBit(s.flags, 7),
+			oam:      s.index,
+		}
+
+		// the sprite already in the FIFO wins unless it is transparent, on
+		// the CGB the sprite earliest in OAM wins instead
+		cur := f.obj.at(i - skip)
+		if cur.colour == 0 || (mem.cgbMode && px.colour != 0 && px.oam < cur.oam) {
+			*cur = px
+		}
+	}
+}
+
+// shift draws the next pixel from the FIFOs, starting the window first if it begins here.
+func (f *fifoRenderer) shift() {
+	if f.bg.size == 0 {
+		return
+	}
+
+	mem := f.p.mem
+	lcdc := mem.Read(LCDC)
+
+	wx := int(mem.Read(WX))
+	scx := int(mem.Read(SCX))
+	if !f.inWindow && f.p.windowVisible(lcdc, wx) && f.p.windowColumn(f.lx, wx, scx) >= 0 {
+		f.inWindow = true
+		f.windowUsed = true
+		f.bg.clear()
+		f.step = 0
+		f.tileX = 0
+
+		// when WX is below 7 the first pixels of the window are off screen,
+		// this replaces any fine scroll still to be thrown away
+		f.discard = max(0, f.p.windowColumn(0, wx, scx))
+		return
+	}
+
+	bg := f.bg.pop()
+	if f.discard > 0 {
+		f.discard--
+		return
+	}
+
+	var obj fifoPixel
+	if f.obj.size > 0 {
+		obj = f.obj.pop()
+	}
+
+	f.draw(lcdc, bg, obj)
+	f.lx++
+}
+
+// draw mixes the background and sprite pixels using the current palettes.
+func (f *fifoRenderer) draw(lcdc byte, bg, obj fifoPixel) {
+	mem := f.p.mem
+	y := f.p.getLine()
+
+	if mem.cgbMode {
+		// clearing bit 0 on the CGB draws sprites over the background regardless of priority
+		bgWins := TestBit(lcdc, 0) && bg.colour != 0 && (obj.priority || bg.priority)
+		if obj.colour != 0 && TestBit(lcdc, 1) && !bgWins {
+			f.p.RenderColourPixel(obj.colour, obj.palette, &mem.objPalettes, f.lx, y)
+		} else {
+			f.p.RenderColourPixel(bg.colour, bg.palette, &mem.bgPalettes, f.lx, y)
+		}
+
+		return
+	}
+
+	// clearing bit 0 on the DMG blanks the background and window
+	if !TestBit(lcdc, 0) {
+		bg.colour = 0
+	}
+
+	if obj.colour != 0 && TestBit(lcdc, 1) && !(obj.priority && bg.colour != 0) {
+		palette := mem.Read(OBP0 + uint16(obj.palette))
+		f.p.RenderPixel(obj.colour, palette, &mem.objPalettes, obj.palette, f.lx, y)
+		return
+	}
+
+	palette := mem.Read(BGP)
+	if !TestBit(lcdc, 0) {
+		palette = 0
+	}
+
+	f.p.RenderPixel(bg.colour, palette, &mem.bgPalettes, 0, f.lx, y)
+}
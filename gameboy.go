@@ -1,50 +1,177 @@
 package main
 
-import "log"
+import (
+	"log"
+
+	"github.com/rbrady98/cluiche/cartridge"
+)
 
 const (
-	ClockSpeed     = 4213440
+	ClockSpeed     = 4194304
 	CyclesPerFrame = 70224
+
+	// FrameRate is how many frames the Gameboy draws a second, about 59.73
+	FrameRate = float64(ClockSpeed) / CyclesPerFrame
+
+	// SaveFlushFrames is how often, in frames, dirty save ram is written to disk
+	SaveFlushFrames = 300
 )
 
 type Gameboy struct {
 	cpu    *CPU
 	ppu    *PPU
+	apu    *APU
+	serial *Serial
 	memory *Memory
 	// input lower nibble contains d pad inputs and higher nibble contains buttons
 	input *Input
+
+	// frames counts the frames since the save ram was last checked
+	frames int
+}
+
+// Options configures how the Gameboy is set up.
+type Options struct {
+	// ROMEntry names the file to load when the rom is in a zip archive, by
+	// default the first .gb or .gbc file is used
+	ROMEntry string
+	// Patch is an IPS, UPS or BPS patch applied to the rom when it is loaded
+	Patch string
+	// BootROM is the boot rom image to run before the game, without one the
+	// game is started with the state the boot rom of Model leaves behind
+	BootROM string
+	// Model is the hardware emulated, by default it is picked from the size of
+	// the boot rom or from the cartridge header so colour games are run on a CGB
+	Model Model
+	// Renderer is how the screen is drawn, the pixel FIFO is slower but
+	// handles registers which are changed part way through a line
+	Renderer Renderer
+	// Unrestricted lets the cpu access VRAM and OAM while the PPU is using
+	// them, for debugging games which are broken by the restrictions
+	Unrestricted bool
+	// SampleRate is the rate audio samples are produced at, by default DefaultSampleRate
+	SampleRate int
+	// Mute and Solo set which sound channels are heard, when channels are
+	// soloed only they are heard
+	Mute Channels
+	Solo Channels
+	// Record is a WAV file the audio is recorded to, with RecordChannels
+	// each channel is also recorded to its own file
+	Record         string
+	RecordChannels bool
+	// LinkListen waits in the background for another emulator to connect a
+	// link cable and LinkConnect connects to one, addresses starting with unix: are unix
+	// sockets and anything else is tcp. Without either the cable is unplugged.
+	LinkListen  string
+	LinkConnect string
+
+	// RTC is what drives the clock of cartridges with a real time clock
+	RTC cartridge.ClockSource
 }
 
-func NewGameboy(romPath string) (*Gameboy, error) {
-	mem := NewMemory()
+func NewGameboy(romPath string, opts Options) (*Gameboy, error) {
+	mem := NewMemory(opts.Model)
 	cpu := NewCPU(mem)
-	ppu := NewPPU(cpu, mem)
+	ppu := NewPPU(cpu, mem, opts.Renderer)
+	apu := NewAPU(opts.SampleRate)
 	input := NewInput()
 
+	serial := NewSerial(cpu, mem)
+
 	mem.cpu = cpu
+	mem.ppu = ppu
+	mem.apu = apu
+	mem.serial = serial
+	mem.unrestricted = opts.Unrestricted
 	mem.input = input
 
 	gb := &Gameboy{
 		cpu:    cpu,
 		ppu:    ppu,
+		apu:    apu,
+		serial: serial,
 		memory: mem,
 		input:  input,
 	}
 
-	err := gb.memory.LoadROM(romPath)
+	err := gb.memory.LoadROM(romPath, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.BootROM != "" {
+		if err := gb.memory.LoadBootROM(opts.BootROM); err != nil {
+			return nil, err
+		}
+	} else {
+		if opts.Model == ModelAuto {
+			opts.Model = cartModel(gb.memory.cart.Header())
+			gb.memory.setModel(opts.Model)
+		}
+
+		gb.memory.SkipBoot(opts.Model)
+		gb.cpu.SkipBoot(opts.Model)
+	}
+
+	heard := AllChannels
+	if opts.Solo != 0 {
+		heard = opts.Solo
+	}
+
+	gb.apu.SetHeard(heard &^ opts.Mute)
+
+	if opts.Record != "" {
+		if err := gb.apu.StartRecording(opts.Record, opts.RecordChannels); err != nil {
+			return nil, err
+		}
+	}
+
+	// the cable is plugged in last so nothing can fail while the peer is connected
+	link, err := openLink(opts)
 	if err != nil {
+		gb.apu.StopRecording()
 		return nil, err
 	}
 
+	gb.serial.link = link
+
 	// gb.GetCartType()
 
 	return gb, nil
 }
 
+// openLink connects the link cable set in opts, returning nil when it is unplugged.
+func openLink(opts Options) (*Link, error) {
+	switch {
+	case opts.LinkListen != "":
+		return ListenLink(opts.LinkListen)
+	case opts.LinkConnect != "":
+		return DialLink(opts.LinkConnect)
+	default:
+		return nil, nil
+	}
+}
+
 func (g *Gameboy) GetRomTitle() string {
 	return g.memory.GetCartTitle()
 }
 
+// Rumble reports whether the cartridge rumble motor is active so the frontend can act on it.
+func (g *Gameboy) Rumble() bool {
+	return g.memory.cart.Rumble()
+}
+
+// SetInfrared connects an infrared port for cartridges with an IR sensor.
+func (g *Gameboy) SetInfrared(ir cartridge.Infrared) {
+	g.memory.cart.SetInfrared(ir)
+}
+
+// SetTilt sets how far the Gameboy is tilted, in g, for cartridges with an
+// accelerometer. Positive x tilts right and positive y tilts towards the player.
+func (g *Gameboy) SetTilt(x, y float64) {
+	g.memory.cart.SetTilt(x, y)
+}
+
 // func (g *Gameboy) GetCartType() {
 // 	g.memory.GetCartidgeType()
 // }
@@ -57,9 +184,77 @@ func (g *Gameboy) Update() {
 		// g.debugLog()
 
 		c := g.cpu.Update()
+
+		// in double speed the rest of the hardware sees half as many cycles
+		if g.cpu.doubleSpeed {
+			c /= 2
+		}
+
 		g.ppu.Update(c)
+		g.apu.Update(c)
+		g.serial.Update(c)
+		g.memory.cart.Tick(c)
 		frameCycles += c
 	}
+
+	g.frames++
+	if g.frames >= SaveFlushFrames {
+		g.frames = 0
+
+		// save periodically so a crash does not lose progress
+		if err := g.memory.cart.Flush(); err != nil {
+			log.Println("save error:", err)
+		}
+	}
+}
+
+// Close writes any battery backed cartridge state to disk, finishes any audio
+// recording and unplugs the link cable.
+func (g *Gameboy) Close() error {
+	recErr := g.apu.StopRecording()
+	g.serial.Close()
+
+	if err := g.memory.cart.Save(); err != nil {
+		return err
+	}
+
+	return recErr
+}
+
+// AudioSamples returns the interleaved stereo samples produced since it was last called.
+func (g *Gameboy) AudioSamples() []float32 {
+	return g.apu.Samples()
+}
+
+// SetHeard sets which sound channels are heard.
+func (g *Gameboy) SetHeard(channels Channels) {
+	g.apu.SetHeard(channels)
+}
+
+// Heard returns the sound channels which are heard.
+func (g *Gameboy) Heard() Channels {
+	return g.apu.Heard()
+}
+
+// StartRecording records the audio to a WAV file at path, and each channel
+// to its own file next to it if perChannel is set.
+func (g *Gameboy) StartRecording(path string, perChannel bool) error {
+	return g.apu.StartRecording(path, perChannel)
+}
+
+// StopRecording finishes the audio recording.
+func (g *Gameboy) StopRecording() error {
+	return g.apu.StopRecording()
+}
+
+// Recording reports whether the audio is being recorded.
+func (g *Gameboy) Recording() bool {
+	return g.apu.Recording()
+}
+
+// SampleRate returns the rate audio samples are produced at.
+func (g *Gameboy) SampleRate() int {
+	return g.apu.SampleRate()
 }
 
 func (g *Gameboy) GetRenderedFrame() []byte {
@@ -0,0 +1,243 @@
+package main
+
+import (
+	"io"
+	"log"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	// linkTimeout is how long to wait to connect to or write to the peer
+	linkTimeout = 10 * time.Second
+	// linkListenTimeout is how long to wait for the peer to connect
+	linkListenTimeout = time.Minute
+	// linkReplyCycles is how long a transfer waits for the peer to reply
+	// before the peer is given up on, 10 seconds of emulated time
+	linkReplyCycles = 10 * ClockSpeed
+
+	linkFrameSize = 3
+	// linkQueueSize is how many frames can wait to be sent or handled, there
+	// is at most one frame for each byte transferred so it is never filled by
+	// a peer which is keeping up
+	linkQueueSize = 64
+
+	linkTransferFlag = 1 << 0
+	linkReplyFlag    = 1 << 1
+)
+
+// linkFrame is sent to the peer when a byte is transferred. It holds the
+// byte of a transfer started with the internal clock or the reply to a
+// transfer started by the peer.
+type linkFrame struct {
+	transfer bool
+	data     byte
+
+	reply     bool
+	replyData byte
+}
+
+// Link is a link cable connection to another emulator. The connection is read
+// and written on goroutines of its own so the emulator never waits on the
+// network, frames are queued with Send and taken from in.
+type Link struct {
+	// in receives the frames sent by the peer, it is closed once the
+	// connection is lost or the peer never connects
+	in   chan linkFrame
+	out  chan linkFrame
+	done chan struct{}
+
+	// connected is set once the peer has connected
+	connected atomic.Bool
+
+	mu       sync.Mutex
+	conn     net.Conn
+	listener net.Listener
+	closed   bool
+}
+
+func newLink() *Link {
+	return &Link{
+		in:   make(chan linkFrame, linkQueueSize),
+		out:  make(chan linkFrame, linkQueueSize),
+		done: make(chan struct{}),
+	}
+}
+
+// ListenLink waits in the background for another emulator to connect to
+// addr, giving up after linkListenTimeout. Until the peer connects the cable
+// is unplugged. Addresses starting with unix: are unix sockets, anything else
+// is a tcp address.
+func ListenLink(addr string) (*Link, error) {
+	network, address := linkAddress(addr)
+
+	ln, err := net.Listen(network, address)
+	if err != nil {
+		return nil, err
+	}
+
+	// both tcp and unix listeners can time out
+	if d, ok := ln.(interface{ SetDeadline(time.Time) error }); ok {
+		if err := d.SetDeadline(time.Now().Add(linkListenTimeout)); err != nil {
+			ln.Close()
+			return nil, err
+		}
+	}
+
+	log.Println("waiting for link cable on", addr)
+
+	l := newLink()
+	l.listener = ln
+
+	go func() {
+		conn, err := ln.Accept()
+		ln.Close()
+
+		if err != nil {
+			log.Println("no link cable connected:", err)
+			close(l.in)
+			return
+		}
+
+		l.start(conn)
+	}()
+
+	return l, nil
+}
+
+// DialLink connects to another emulator listening on addr.
+func DialLink(addr string) (*Link, error) {
+	network, address := linkAddress(addr)
+
+	conn, err := net.DialTimeout(network, address, linkTimeout)
+	if err != nil {
+		return nil, err
+	}
+
+	l := newLink()
+	l.start(conn)
+
+	return l, nil
+}
+
+func linkAddress(addr string) (network, address string) {
+	if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+		return "unix", path
+	}
+
+	return "tcp", strings.TrimPrefix(addr, "tcp:")
+}
+
+// start runs the connection to the peer.
+func (l *Link) start(conn net.Conn) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		conn.Close()
+		close(l.in)
+		return
+	}
+
+	l.conn = conn
+	l.connected.Store(true)
+
+	go l.read(conn)
+	go l.write(conn)
+}
+
+// read passes the frames from the peer to in until the connection is lost.
+func (l *Link) read(conn net.Conn) {
+	defer close(l.in)
+
+	var buf [linkFrameSize]byte
+	for {
+		if _, err := io.ReadFull(conn, buf[:]); err != nil {
+			return
+		}
+
+		frame := linkFrame{
+			transfer:  buf[0]&linkTransferFlag != 0,
+			data:      buf[1],
+			reply:     buf[0]&linkReplyFlag != 0,
+			replyData: buf[2],
+		}
+
+		select {
+		case l.in <- frame:
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// write sends the queued frames to the peer, a failed write closes the
+// connection so read sees it as well.
+func (l *Link) write(conn net.Conn) {
+	for {
+		select {
+		case f := <-l.out:
+			var flags byte
+			if f.transfer {
+				flags |= linkTransferFlag
+			}
+
+			if f.reply {
+				flags |= linkReplyFlag
+			}
+
+			if err := conn.SetWriteDeadline(time.Now().Add(linkTimeout)); err != nil {
+				conn.Close()
+				return
+			}
+
+			if _, err := conn.Write([]byte{flags, f.data, f.replyData}); err != nil {
+				conn.Close()
+				return
+			}
+
+		case <-l.done:
+			return
+		}
+	}
+}
+
+// Connected reports whether the peer has connected.
+func (l *Link) Connected() bool {
+	return l.connected.Load()
+}
+
+// Send queues a frame for the peer. The frame is dropped if the queue is
+// full, which only happens when the peer has stopped reading.
+func (l *Link) Send(f linkFrame) {
+	select {
+	case l.out <- f:
+	default:
+		log.Println("link cable peer isn't reading, dropping a byte")
+	}
+}
+
+func (l *Link) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if l.closed {
+		return nil
+	}
+
+	l.closed = true
+	close(l.done)
+
+	if l.listener != nil {
+		l.listener.Close()
+	}
+
+	if l.conn != nil {
+		return l.conn.Close()
+	}
+
+	return nil
+}
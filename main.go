@@ -1,6 +1,8 @@
 package main
 
 import (
+	"flag"
+	"fmt"
 	"log"
 	// "os"
 
@@ -16,10 +18,69 @@ func main() {
 	// log.SetFlags(log.Flags() &^ (log.Ldate | log.Ltime))
 	// log.SetOutput(logFile)
 
-	game := NewGame(160*2, 144*2, "./roms/kirbys-dreamland.gb")
+	var opts Options
+	flag.StringVar(&opts.ROMEntry, "entry", "", "file to load when the rom is in a zip archive")
+	flag.StringVar(&opts.Patch, "patch", "", "IPS, UPS or BPS patch to apply to the rom")
+	flag.StringVar(&opts.BootROM, "boot", "", "boot rom image to run before the game")
+	flag.Var(&opts.Model, "model", "hardware model to emulate: auto, dmg0, dmg, mgb, sgb or cgb, auto picks cgb for colour games")
+	flag.Var(&opts.Renderer, "renderer", "how the screen is drawn: scanline or fifo")
+	flag.BoolVar(&opts.Unrestricted, "unrestricted", false, "let the cpu access VRAM and OAM while the PPU is drawing")
+	flag.IntVar(&opts.SampleRate, "rate", DefaultSampleRate, "audio sample rate")
+	flag.Var(&opts.Mute, "mute", "sound channels to mute, e.g. 24")
+	flag.Var(&opts.Solo, "solo", "sound channels to solo, e.g. 1")
+	flag.StringVar(&opts.Record, "record", "", "WAV file to record the audio to")
+	flag.BoolVar(&opts.RecordChannels, "record-channels", false, "also record each sound channel to its own WAV file")
+	flag.StringVar(&opts.LinkListen, "link-listen", "", "wait for a link cable connection on an address, e.g. :5000 or unix:/tmp/link")
+	flag.StringVar(&opts.LinkConnect, "link-connect", "", "connect a link cable to an emulator listening on an address")
+	headless := flag.Bool("headless", false, "run without a window or sound")
+	frames := flag.Int("frames", 600, "number of frames to run before exiting when headless")
+	flag.Var(&opts.RTC, "rtc", "what drives the cartridge clock: host or emulated")
+	flag.Parse()
+
+	romPath := "./roms/kirbys-dreamland.gb"
+	if flag.NArg() > 0 {
+		romPath = flag.Arg(0)
+	}
+
+	if *headless {
+		if err := runHeadless(romPath, opts, *frames); err != nil {
+			log.Fatal(err)
+		}
+
+		return
+	}
+
+	game := NewGame(160*2, 144*2, romPath, opts)
 	ebiten.SetWindowSize(160*4, 144*4)
 	ebiten.SetWindowTitle(game.gb.GetRomTitle())
-	if err := ebiten.RunGame(game); err != nil {
+	err := ebiten.RunGame(game)
+
+	// save before exiting so progress is kept even if the game errored
+	if err := game.gb.Close(); err != nil {
+		log.Println("save error:", err)
+	}
+
+	if err != nil {
 		log.Fatal("game error:", err)
 	}
 }
+
+// runHeadless runs the game for the given number of frames without a window, any audio
+// recording is written as normal.
+func runHeadless(romPath string, opts Options, frames int) error {
+	if frames <= 0 {
+		return fmt.Errorf("headless runs need a positive number of frames, got %d", frames)
+	}
+
+	gb, err := NewGameboy(romPath, opts)
+	if err != nil {
+		return err
+	}
+
+	for i := 0; i < frames; i++ {
+		gb.Update()
+		gb.AudioSamples()
+	}
+
+	return gb.Close()
+}
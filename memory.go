@@ -1,7 +1,11 @@
 package main
 
 import (
+	"fmt"
+	"log"
 	"os"
+	"path/filepath"
+	"strings"
 
 	"github.com/rbrady98/cluiche/cartridge"
 )
@@ -18,15 +22,72 @@ const (
 	IO                      = 0xFF80
 	HRAM                    = 0xFFFF
 	InterruptEnableRegister = 0xFFFF
+
+	// serial transfer data and control
+	SB uint16 = 0xFF01
+	SC uint16 = 0xFF02
+
+	// BootROMDisable unmaps the boot rom when written to
+	BootROMDisable uint16 = 0xFF50
+
+	// FixedWRAM is the end of WRAM bank 0, the CGB can switch the bank above it
+	FixedWRAM    = 0xD000
+	wramBankSize = 0x1000
+
+	// echoRAMOffset is how far echo RAM is above the WRAM it mirrors
+	echoRAMOffset = 0x2000
+
+	// boot rom sizes, the cgb boot rom is also mapped over 0x0200-0x08FF
+	dmgBootROMSize = 0x100
+	cgbBootROMSize = 0x900
 )
 
+// ioReadMasks are ORed into the io registers when they are read, unused bits
+// and registers that aren't mapped read as 1
+var ioReadMasks = func() (masks [0x80]byte) {
+	for i := range masks {
+		masks[i] = 0xFF
+	}
+
+	registers := map[uint16]byte{
+		JOYP: 0xC0,
+		DIV:  0x00,
+		TIMA: 0x00,
+		TMA:  0x00,
+		TAC:  0xF8,
+
+		InterruptFlagReg: 0xE0,
+
+		LCDC: 0x00,
+		STAT: 0x80,
+		SCY:  0x00,
+		SCX:  0x00,
+		LY:   0x00,
+		LYC:  0x00,
+		DMA:  0x00,
+		BGP:  0x00,
+		OBP0: 0x00,
+		OBP1: 0x00,
+		WY:   0x00,
+		WX:   0x00,
+	}
+
+	for addr, mask := range registers {
+		masks[addr-NotUsable] = mask
+	}
+
+	return masks
+}()
+
 type Memory struct {
 	// cart memory
 	cart *cartridge.Cart
-	// VRAM
-	vram [0x2000]byte
-	// WRAM
-	wram [0x2000]byte
+	// VRAM, the CGB has a second bank
+	vram     [2][0x2000]byte
+	vramBank int
+	// WRAM, the DMG only uses banks 0 and 1 while the CGB can switch banks 1-7
+	wram     [8][wramBankSize]byte
+	wramBank int
 	// OAM
 	oam [0x100]byte
 	// IO
@@ -37,36 +98,55 @@ type Memory struct {
 	interruptEnable byte
 	// mem  [0xFFFF + 1]byte
 
-	cpu   *CPU
-	input *Input
+	// bootROM is mapped over the cartridge until BootROMDisable is written
+	bootROM        []byte
+	bootROMEnabled bool
+
+	// model is the hardware being emulated, cgbMode is set when running a
+	// CGB game on CGB hardware
+	model   Model
+	cgbMode bool
+
+	bgPalettes  colourPalettes
+	objPalettes colourPalettes
+	hdma        hdma
+	dma         oamDMA
+
+	// stallCycles is how long the cpu is stopped by HDMA transfers
+	stallCycles int
+
+	// unrestricted lets the cpu access VRAM and OAM whatever mode the PPU is in
+	unrestricted bool
+
+	cpu    *CPU
+	ppu    *PPU
+	apu    *APU
+	serial *Serial
+	input  *Input
 }
 
-func NewMemory() *Memory {
-	m := &Memory{}
+func NewMemory(model Model) *Memory {
+	m := &Memory{wramBank: 1}
+	m.setModel(model)
+
+	return m
+}
+
+// setModel sets the hardware being emulated, colour mode is on for the CGB
+// until the boot rom or SkipBoot turns it off for DMG games.
+func (m *Memory) setModel(model Model) {
+	m.model = model
+	m.cgbMode = model == ModelCGB
+}
 
+// SkipBoot sets the io registers to the values the boot rom of the model leaves behind.
+func (m *Memory) SkipBoot(model Model) {
 	m.io[0x00] = 0xCF
+	m.io[0x04] = postBootStates[model].div
 	m.io[0x05] = 0x00
 	m.io[0x06] = 0x00
 	m.io[0x07] = 0xF8
 	m.io[0x0F] = 0xE1
-	m.io[0x10] = 0x80
-	m.io[0x11] = 0xBF
-	m.io[0x12] = 0xF3
-	m.io[0x14] = 0xBF
-	m.io[0x16] = 0x3F
-	m.io[0x17] = 0x00
-	m.io[0x19] = 0xBF
-	m.io[0x1A] = 0x7F
-	m.io[0x1B] = 0xFF
-	m.io[0x1C] = 0x9F
-	m.io[0x1E] = 0xBF
-	m.io[0x20] = 0xFF
-	m.io[0x21] = 0x00
-	m.io[0x22] = 0x00
-	m.io[0x23] = 0xBF
-	m.io[0x24] = 0x77
-	m.io[0x25] = 0xF3
-	m.io[0x26] = 0xF1
 	m.io[0x40] = 0x91
 	m.io[0x42] = 0x00
 	m.io[0x43] = 0x00
@@ -76,42 +156,130 @@ func NewMemory() *Memory {
 	m.io[0x49] = 0xFF
 	m.io[0x4A] = 0x00
 	m.io[0x4B] = 0x00
+	m.io[BootROMDisable-NotUsable] = 0xFF
 	m.interruptEnable = 0x00
+	m.apu.SkipBoot()
 
-	return m
+	if model == ModelCGB {
+		// the boot rom only leaves colour mode on for colour games
+		m.cgbMode = m.cart.Header().CGBFlag&0x80 != 0
+		m.skipBootCGB()
+	}
+}
+
+// LoadBootROM maps the boot rom image over the start of the cartridge, the
+// image must be the size of the model's boot rom.
+func (m *Memory) LoadBootROM(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+
+	if len(data) != dmgBootROMSize && len(data) != cgbBootROMSize {
+		return fmt.Errorf("boot rom must be %d or %d bytes but is %d bytes", dmgBootROMSize, cgbBootROMSize, len(data))
+	}
+
+	// the boot rom picks the model when it isn't set, otherwise it has to
+	// be the boot rom of that model
+	model := ModelDMG
+	if len(data) == cgbBootROMSize {
+		model = ModelCGB
+	}
+
+	if m.model == ModelAuto {
+		m.setModel(model)
+	} else if (m.model == ModelCGB) != (model == ModelCGB) {
+		return fmt.Errorf("%d byte boot rom is not for the %s model", len(data), m.model)
+	}
+
+	m.bootROM = data
+	m.bootROMEnabled = true
+
+	return nil
+}
+
+// inBootROM reports whether addr is currently mapped to the boot rom.
+func (m *Memory) inBootROM(addr uint16) bool {
+	if !m.bootROMEnabled {
+		return false
+	}
+
+	// the cgb boot rom leaves a gap for the cartridge header
+	return addr < dmgBootROMSize || (addr >= 0x200 && int(addr) < len(m.bootROM))
 }
 
 func (m *Memory) Read(addr uint16) byte {
+	// the cpu sees the byte being copied while a DMA transfer has the bus
+	if m.dmaConflict(addr) {
+		if addr >= EchoRAM {
+			return 0xFF
+		}
+
+		return m.dma.value
+	}
+
+	return m.read(addr)
+}
+
+// read reads from memory without any DMA bus conflicts.
+func (m *Memory) read(addr uint16) byte {
 	switch {
+	case m.inBootROM(addr):
+		return m.bootROM[addr]
+
 	case addr < CartridgeROM:
 		return m.cart.Read(addr)
 
 	case addr < VRAM:
-		return m.vram[addr-CartridgeROM]
+		if !m.vramAccessible() {
+			return 0xFF
+		}
+
+		return m.vram[m.vramBank][addr-CartridgeROM]
 
 	case addr < ExternalRAM:
 		return m.cart.Read(addr)
 
+	case addr < FixedWRAM:
+		return m.wram[0][addr-ExternalRAM]
+
 	case addr < WRAM:
-		return m.wram[addr-ExternalRAM]
+		return m.wram[m.wramBank][addr-FixedWRAM]
 
 	case addr < EchoRAM:
-		// noop not implementing echo ram
-		return 0xFF
+		// echo ram mirrors WRAM
+		return m.read(addr - echoRAMOffset)
 
 	case addr < OAM:
+		if !m.oamAccessible() {
+			return 0xFF
+		}
+
 		return m.oam[addr-EchoRAM]
 
 	case addr < NotUsable:
-		// noop gameboy is not allowed to read from this addr
-		return 0xFF
+		return m.readUnusable(addr)
 
 	case addr < IO:
 		if addr == JOYP {
-			return m.input.GetInput(m.io[JOYP-0xFF00])
+			return m.input.GetInput(m.io[JOYP-0xFF00]) | ioReadMasks[JOYP-NotUsable]
 		}
 
-		return m.io[addr-NotUsable]
+		if addr == SB || addr == SC {
+			return m.serial.Read(addr)
+		}
+
+		if addr >= NR10 && addr < WaveRAMEnd {
+			return m.apu.Read(addr)
+		}
+
+		if m.cgbMode {
+			if val, ok := m.readCGB(addr); ok {
+				return val
+			}
+		}
+
+		return m.io[addr-NotUsable] | ioReadMasks[addr-NotUsable]
 
 	case addr < HRAM:
 		return m.hram[addr-IO]
@@ -122,27 +290,40 @@ func (m *Memory) Read(addr uint16) byte {
 }
 
 func (m *Memory) Write(addr uint16, val byte) {
+	// writes are lost while a DMA transfer has the bus
+	if m.dmaConflict(addr) {
+		return
+	}
+
 	switch {
 	case addr < CartridgeROM:
 		m.cart.WriteROM(addr, val)
 
 	case addr < VRAM:
-		m.vram[addr-CartridgeROM] = val
+		if m.vramAccessible() {
+			m.vram[m.vramBank][addr-CartridgeROM] = val
+		}
 
 	case addr < ExternalRAM:
 		m.cart.WriteRAM(addr, val)
 
+	case addr < FixedWRAM:
+		m.wram[0][addr-ExternalRAM] = val
+
 	case addr < WRAM:
-		m.wram[addr-ExternalRAM] = val
+		m.wram[m.wramBank][addr-FixedWRAM] = val
 
 	case addr < EchoRAM:
-		// noop not implementing echo ram
+		// echo ram mirrors WRAM
+		m.Write(addr-echoRAMOffset, val)
 
 	case addr < OAM:
-		m.oam[addr-EchoRAM] = val
+		if m.oamAccessible() {
+			m.oam[addr-EchoRAM] = val
+		}
 
 	case addr < NotUsable:
-		// noop gameboy is not allowed to read from this addr
+		// writes to the unusable area are ignored
 
 	case addr < IO:
 		// TODO: if this gets longer write a WriteIO method
@@ -151,6 +332,20 @@ func (m *Memory) Write(addr uint16, val byte) {
 			return
 		}
 
+		if addr == SB || addr == SC {
+			m.serial.Write(addr, val)
+			return
+		}
+
+		if addr >= NR10 && addr < WaveRAMEnd {
+			m.apu.Write(addr, val)
+			return
+		}
+
+		if m.cgbMode && m.writeCGB(addr, val) {
+			return
+		}
+
 		// reset the divider register when written to
 		if addr == DIV {
 			m.io[addr-NotUsable] = 0
@@ -172,9 +367,25 @@ func (m *Memory) Write(addr uint16, val byte) {
 			return
 		}
 
+		// the mode and LY=LYC bits of STAT are read only
+		if addr == STAT {
+			m.io[addr-NotUsable] = val&0x78 | m.io[addr-NotUsable]&0x07
+			return
+		}
+
+		// unmapping the boot rom can't be undone
+		if addr == BootROMDisable {
+			if val != 0 {
+				m.bootROMEnabled = false
+			}
+
+			m.io[addr-NotUsable] = 0xFF
+			return
+		}
+
 		// DMA transfer
-		if addr == 0xFF46 {
-			m.doDMATransfer(val)
+		if addr == DMA {
+			m.startDMA(val)
 			return
 		}
 
@@ -188,31 +399,89 @@ func (m *Memory) Write(addr uint16, val byte) {
 	}
 }
 
-func (m *Memory) LoadROM(path string) error {
-	data, err := os.ReadFile(path)
+// LoadROM loads the rom at path, which may be inside a zip or gzip archive.
+// The save file is named after path so it stays with the archive.
+//
+// The rom is patched with the patch given in opts, or otherwise with an IPS,
+// UPS or BPS patch found next to the rom. Patched roms are saved next to the
+// patch so they do not overwrite the save of the original game.
+func (m *Memory) LoadROM(path string, opts Options) error {
+	data, err := readROM(path, opts.ROMEntry)
 	if err != nil {
 		return err
 	}
 
-	c, err := cartridge.NewCart(data)
+	save := savePath(path)
+
+	patch := opts.Patch
+	if patch == "" {
+		patch = findPatch(path)
+	}
+
+	if patch != "" {
+		data, err = applyPatchFile(data, patch)
+		if err != nil {
+			return err
+		}
+
+		save = patch + ".sav"
+	}
+
+	c, err := cartridge.NewCart(data, save, opts.RTC)
 	if err != nil {
 		return err
 	}
 
+	// the gameboy never checks the global checksum and only the boot rom
+	// checks the header one, so only warn about them
+	if err := c.Header().VerifyHeaderChecksum(data); err != nil {
+		log.Println("warning:", err)
+	}
+
+	if err := c.Header().VerifyGlobalChecksum(data); err != nil {
+		log.Println("warning:", err)
+	}
+
 	m.cart = c
 
 	return nil
 }
 
-func (m *Memory) GetCartTitle() string {
-	return m.cart.Title()
+// savePath returns the path of the save file which belongs to the rom at path.
+func savePath(path string) string {
+	return strings.TrimSuffix(path, filepath.Ext(path)) + ".sav"
 }
 
-func (m *Memory) doDMATransfer(value byte) {
-	// TODO: how can we get this to take 160 cycles
-	addr := uint16(value) << 8
+// readVRAM reads from a VRAM bank, the PPU uses this to read both banks
+// regardless of which one the cpu has selected.
+func (m *Memory) readVRAM(bank int, addr uint16) byte {
+	return m.vram[bank][addr-CartridgeROM]
+}
 
-	for i := uint16(0); i < 0xA0; i++ {
-		m.oam[i] = m.Read(addr + i)
+// readUnusable reads the unusable area between OAM and the io registers. It
+// is locked along with OAM, otherwise the DMG reads 0 and the CGB reads the
+// high nibble of the address twice.
+func (m *Memory) readUnusable(addr uint16) byte {
+	if !m.oamAccessible() {
+		return 0xFF
 	}
+
+	if m.model == ModelCGB {
+		nibble := byte(addr) & 0xF0
+		return nibble | nibble>>4
+	}
+
+	return 0x00
+}
+
+func (m *Memory) vramAccessible() bool {
+	return m.unrestricted || m.ppu.vramAccessible()
+}
+
+func (m *Memory) oamAccessible() bool {
+	return m.unrestricted || m.ppu.oamAccessible()
+}
+
+func (m *Memory) GetCartTitle() string {
+	return m.cart.Title()
 }
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestLoadBootROM(t *testing.T) {
+	tests := []struct {
+		name      string
+		model     Model
+		size      int
+		wantModel Model
+		wantErr   bool
+	}{
+		{name: "dmg", model: ModelDMG, size: dmgBootROMSize, wantModel: ModelDMG},
+		{name: "cgb", model: ModelCGB, size: cgbBootROMSize, wantModel: ModelCGB},
+		{name: "auto dmg", model: ModelAuto, size: dmgBootROMSize, wantModel: ModelDMG},
+		{name: "auto cgb", model: ModelAuto, size: cgbBootROMSize, wantModel: ModelCGB},
+		{name: "cgb boot rom on dmg", model: ModelDMG, size: cgbBootROMSize, wantErr: true},
+		{name: "dmg boot rom on cgb", model: ModelCGB, size: dmgBootROMSize, wantErr: true},
+		{name: "wrong size", model: ModelAuto, size: 0x200, wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "boot.bin")
+			if err := os.WriteFile(path, make([]byte, tt.size), 0o644); err != nil {
+				t.Fatal(err)
+			}
+
+			m := NewMemory(tt.model)
+			err := m.LoadBootROM(path)
+
+			if tt.wantErr {
+				if err == nil {
+					t.Error("LoadBootROM() succeeded, want an error")
+				}
+
+				if m.bootROMEnabled {
+					t.Error("boot rom is mapped after an error")
+				}
+
+				return
+			}
+
+			if err != nil {
+				t.Fatalf("LoadBootROM() error: %v", err)
+			}
+
+			if m.model != tt.wantModel || m.cgbMode != (tt.wantModel == ModelCGB) {
+				t.Errorf("model is %s with cgb mode %t, want %s", m.model, m.cgbMode, tt.wantModel)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/rbrady98/cluiche/cartridge"
+)
+
+// Model is the Gameboy hardware revision being emulated.
+type Model int
+
+const (
+	ModelAuto Model = iota // picked from the cartridge header
+	ModelDMG               // original Gameboy
+	ModelDMG0              // early original Gameboy
+	ModelMGB               // Gameboy Pocket
+	ModelSGB               // Super Gameboy
+	ModelCGB               // Gameboy Color
+)
+
+var modelNames = map[Model]string{
+	ModelAuto: "auto",
+	ModelDMG0: "dmg0",
+	ModelDMG:  "dmg",
+	ModelMGB:  "mgb",
+	ModelSGB:  "sgb",
+	ModelCGB:  "cgb",
+}
+
+func (m Model) String() string {
+	if name, ok := modelNames[m]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// ParseModel returns the model with the given name.
+func ParseModel(name string) (Model, error) {
+	for m, n := range modelNames {
+		if strings.EqualFold(n, name) {
+			return m, nil
+		}
+	}
+
+	return 0, fmt.Errorf("unknown model: %s", name)
+}
+
+// Set implements flag.Value.
+func (m *Model) Set(name string) error {
+	model, err := ParseModel(name)
+	if err != nil {
+		return err
+	}
+
+	*m = model
+
+	return nil
+}
+
+// cartModel returns the model used for the cartridge when none is chosen,
+// games which support colour are run on a CGB.
+func cartModel(h *cartridge.Header) Model {
+	if h.CGBFlag&0x80 != 0 {
+		return ModelCGB
+	}
+
+	return ModelDMG
+}
+
+// postBootState holds the state each model's boot rom leaves behind, it is
+// used to start games directly when there is no boot rom to run.
+type postBootState struct {
+	af, bc, de, hl uint16
+	div            byte
+}
+
+var postBootStates = map[Model]postBootState{
+	ModelDMG0: {af: 0x0100, bc: 0xFF13, de: 0x00C1, hl: 0x8403, div: 0x18},
+	ModelDMG:  {af: 0x01B0, bc: 0x0013, de: 0x00D8, hl: 0x014D, div: 0xAB},
+	ModelMGB:  {af: 0xFFB0, bc: 0x0013, de: 0x00D8, hl: 0x014D, div: 0xAB},
+	ModelSGB:  {af: 0x0100, bc: 0x0014, de: 0x0000, hl: 0xC060, div: 0xD8},
+	ModelCGB:  {af: 0x1180, bc: 0x0000, de: 0xFF56, hl: 0x000D, div: 0x1E},
+}
+
+// postBootFlags returns the flags left by the boot rom. The DMG and MGB boot
+// roms leave the half carry and carry flags clear when the header checksum is zero.
+func (s postBootState) postBootFlags(model Model, headerChecksum byte) byte {
+	f := byte(s.af)
+	if (model == ModelDMG || model == ModelMGB) && headerChecksum == 0 {
+		f &^= 1<<HalfCarryFlagBitPosition | 1<<CarryFlagBitPosition
+	}
+
+	return f
+}
@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var (
+	ipsMagic = []byte("PATCH")
+	ipsEOF   = []byte("EOF")
+	upsMagic = []byte("UPS1")
+	bpsMagic = []byte("BPS1")
+
+	// patchExts are the patch files looked for next to a rom, in order
+	patchExts = []string{".ips", ".ups", ".bps"}
+)
+
+const (
+	// ups and bps patches end with the source, target and patch checksums
+	patchFooterSize = 12
+
+	bpsSourceRead = 0
+	bpsTargetRead = 1
+	bpsSourceCopy = 2
+	bpsTargetCopy = 3
+)
+
+var errPatchTruncated = errors.New("patch is truncated")
+
+// findPatch returns the path of a patch file next to the rom at path, or an
+// empty string if there is none.
+func findPatch(path string) string {
+	stem := strings.TrimSuffix(path, filepath.Ext(path))
+
+	for _, ext := range patchExts {
+		p := stem + ext
+		if _, err := os.Stat(p); err == nil {
+			return p
+		} else if !errors.Is(err, fs.ErrNotExist) {
+			return ""
+		}
+	}
+
+	return ""
+}
+
+// applyPatchFile patches the rom with the IPS, UPS or BPS patch at path.
+func applyPatchFile(rom []byte, path string) ([]byte, error) {
+	patch, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	patched, err := applyPatch(rom, patch)
+	if err != nil {
+		return nil, fmt.Errorf("applying patch %s: %w", path, err)
+	}
+
+	return patched, nil
+}
+
+// applyPatch patches the rom, the patch format is detected from its magic number.
+func applyPatch(rom, patch []byte) ([]byte, error) {
+	switch {
+	case bytes.HasPrefix(patch, ipsMagic):
+		return applyIPS(rom, patch)
+	case bytes.HasPrefix(patch, upsMagic):
+		return applyUPS(rom, patch)
+	case bytes.HasPrefix(patch, bpsMagic):
+		return applyBPS(rom, patch)
+	default:
+		return nil, errors.New("unknown patch format")
+	}
+}
+
+// applyIPS applies an IPS patch. Records are a 3 byte offset and 2 byte size
+// followed by the data, a size of zero means the data is a run of one byte.
+func applyIPS(rom, patch []byte) ([]byte, error) {
+	out := append([]byte(nil), rom...)
+	r := patchReader{data: patch, pos: len(ipsMagic)}
+
+	for {
+		if bytes.HasPrefix(r.data[r.pos:], ipsEOF) && (len(r.data)-r.pos == 3 || len(r.data)-r.pos == 6) {
+			break
+		}
+
+		offset := int(r.uint(3))
+		size := int(r.uint(2))
+
+		var data []byte
+		if size == 0 {
+			// run length encoded record
+			size = int(r.uint(2))
+			data = bytes.Repeat([]byte{r.byte()}, size)
+		} else {
+			data = r.bytes(size)
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if offset+size > maxROMSize {
+			return nil, fmt.Errorf("patch writes past the largest rom size at %06X", offset)
+		}
+
+		if offset+size > len(out) {
+			out = append(out, make([]byte, offset+size-len(out))...)
+		}
+
+		copy(out[offset:], data)
+	}
+
+	// some patches truncate the rom after the EOF marker
+	r.pos += len(ipsEOF)
+	if len(r.data)-r.pos == 3 {
+		if size := int(r.uint(3)); size < len(out) {
+			out = out[:size]
+		}
+	}
+
+	return out, nil
+}
+
+// applyUPS applies a UPS patch. Hunks are a skip count followed by bytes which
+// are xored with the source until a zero byte.
+func applyUPS(rom, patch []byte) ([]byte, error) {
+	if err := checkFooter(rom, patch); err != nil {
+		return nil, err
+	}
+
+	r := patchReader{data: patch[:len(patch)-patchFooterSize], pos: len(upsMagic)}
+	sourceSize := r.varint()
+	targetSize := r.varint()
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if sourceSize != uint64(len(rom)) {
+		return nil, fmt.Errorf("patch expects a %d byte rom but rom is %d bytes", sourceSize, len(rom))
+	}
+
+	if targetSize > maxROMSize {
+		return nil, fmt.Errorf("patched rom would be %d bytes", targetSize)
+	}
+
+	out := make([]byte, targetSize)
+	copy(out, rom)
+
+	pos := uint64(0)
+	for r.pos < len(r.data) && r.err == nil {
+		pos += r.varint()
+
+		for r.err == nil {
+			x := r.byte()
+			if pos < targetSize {
+				out[pos] ^= x
+			}
+
+			pos++
+			if x == 0 {
+				break
+			}
+		}
+	}
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	return out, checkTarget(out, patch)
+}
+
+// applyBPS applies a BPS patch, which builds the rom from copies of the
+// source, the patch and the already written parts of the rom.
+func applyBPS(rom, patch []byte) ([]byte, error) {
+	if err := checkFooter(rom, patch); err != nil {
+		return nil, err
+	}
+
+	r := patchReader{data: patch[:len(patch)-patchFooterSize], pos: len(bpsMagic)}
+	sourceSize := r.varint()
+	targetSize := r.varint()
+	metadataSize := r.varint()
+	r.bytes(int(min(metadataSize, uint64(len(r.data)))))
+
+	if r.err != nil {
+		return nil, r.err
+	}
+
+	if sourceSize != uint64(len(rom)) {
+		return nil, fmt.Errorf("patch expects a %d byte rom but rom is %d bytes", sourceSize, len(rom))
+	}
+
+	if targetSize > maxROMSize {
+		return nil, fmt.Errorf("patched rom would be %d bytes", targetSize)
+	}
+
+	out := make([]byte, targetSize)
+	var outPos, sourceRel, targetRel int
+
+	for r.pos < len(r.data) {
+		data := r.varint()
+		length := int(data>>2) + 1
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		if length > len(out)-outPos {
+			return nil, errors.New("patch writes past the end of the rom")
+		}
+
+		switch data & 0x3 {
+		case bpsSourceRead:
+			if length > len(rom)-outPos {
+				return nil, errors.New("patch reads past the end of the source rom")
+			}
+
+			copy(out[outPos:], rom[outPos:outPos+length])
+
+		case bpsTargetRead:
+			copy(out[outPos:], r.bytes(length))
+
+		case bpsSourceCopy:
+			// compare without adding so a huge offset can't overflow
+			sourceRel += r.signedVarint()
+			if sourceRel < 0 || sourceRel > len(rom)-length {
+				return nil, errors.New("patch copies from outside the source rom")
+			}
+
+			copy(out[outPos:], rom[sourceRel:sourceRel+length])
+			sourceRel += length
+
+		case bpsTargetCopy:
+			targetRel += r.signedVarint()
+			if targetRel < 0 || targetRel >= outPos {
+				return nil, errors.New("patch copies from outside the written rom")
+			}
+
+			// the copy can overlap what it is writing so go a byte at a time
+			for i := 0; i < length; i++ {
+				out[outPos+i] = out[targetRel]
+				targetRel++
+			}
+		}
+
+		if r.err != nil {
+			return nil, r.err
+		}
+
+		outPos += length
+	}
+
+	return out, checkTarget(out, patch)
+}
+
+// checkFooter verifies the checksums of the patch and the source rom.
+func checkFooter(rom, patch []byte) error {
+	if len(patch) < len(upsMagic)+patchFooterSize {
+		return errPatchTruncated
+	}
+
+	footer := patch[len(patch)-patchFooterSize:]
+
+	if sum := crc32.ChecksumIEEE(patch[:len(patch)-4]); sum != binary.LittleEndian.Uint32(footer[8:]) {
+		return fmt.Errorf("patch checksum mismatch: computed %08X", sum)
+	}
+
+	if sum := crc32.ChecksumIEEE(rom); sum != binary.LittleEndian.Uint32(footer) {
+		return fmt.Errorf("patch is for a different rom: rom checksum is %08X but patch expects %08X", sum, binary.LittleEndian.Uint32(footer))
+	}
+
+	return nil
+}
+
+// checkTarget verifies the checksum of the patched rom.
+func checkTarget(out, patch []byte) error {
+	want := binary.LittleEndian.Uint32(patch[len(patch)-8:])
+	if sum := crc32.ChecksumIEEE(out); sum != want {
+		return fmt.Errorf("patched rom checksum mismatch: computed %08X but patch expects %08X", sum, want)
+	}
+
+	return nil
+}
+
+// patchReader reads the values used by the patch formats, the first error is
+// kept and later reads return zero values.
+type patchReader struct {
+	data []byte
+	pos  int
+	err  error
+}
+
+func (r *patchReader) bytes(n int) []byte {
+	if r.err != nil || n < 0 || r.pos+n > len(r.data) {
+		r.err = errPatchTruncated
+		return nil
+	}
+
+	b := r.data[r.pos : r.pos+n]
+	r.pos += n
+
+	return b
+}
+
+func (r *patchReader) byte() byte {
+	b := r.bytes(1)
+	if b == nil {
+		return 0
+	}
+
+	return b[0]
+}
+
+// uint reads an n byte big endian number.
+func (r *patchReader) uint(n int) uint32 {
+	var v uint32
+	for _, b := range r.bytes(n) {
+		v = v<<8 | uint32(b)
+	}
+
+	return v
+}
+
+// varint reads the variable length numbers used by UPS and BPS. Each byte
+// holds 7 bits and the top bit marks the last byte.
+func (r *patchReader) varint() uint64 {
+	var v uint64
+	shift := uint64(1)
+
+	for i := 0; i < 10; i++ {
+		x := r.byte()
+		if r.err != nil {
+			return 0
+		}
+
+		v += uint64(x&0x7F) * shift
+		if x&0x80 != 0 {
+			return v
+		}
+
+		shift <<= 7
+		v += shift
+	}
+
+	r.err = errors.New("patch number is too long")
+
+	return 0
+}
+
+// signedVarint reads a BPS relative offset, the lowest bit is the sign.
+func (r *patchReader) signedVarint() int {
+	v := r.varint()
+	if v&1 == 1 {
+		return -int(v >> 1)
+	}
+
+	return int(v >> 1)
+}
@@ -0,0 +1,215 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"math"
+	"testing"
+)
+
+var patchTestROM = []byte{1, 2, 3, 4}
+
+func TestApplyIPS(t *testing.T) {
+	tests := []struct {
+		name    string
+		patch   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{
+			name:  "record",
+			patch: ipsPatch([]byte{0, 0, 1, 0, 2, 8, 9}),
+			want:  []byte{1, 8, 9, 4},
+		},
+		{
+			name:  "rle record",
+			patch: ipsPatch([]byte{0, 0, 1, 0, 0, 0, 3, 7}),
+			want:  []byte{1, 7, 7, 7},
+		},
+		{
+			name:  "grows rom",
+			patch: ipsPatch([]byte{0, 0, 5, 0, 1, 9}),
+			want:  []byte{1, 2, 3, 4, 0, 9},
+		},
+		{
+			name:  "truncation footer",
+			patch: append(ipsPatch([]byte{0, 0, 0, 0, 1, 5}), 0, 0, 2),
+			want:  []byte{5, 2},
+		},
+		{
+			name:    "truncated record",
+			patch:   []byte("PATCH\x00\x00\x01\x00\x04\x08"),
+			wantErr: true,
+		},
+		{
+			name:    "missing eof",
+			patch:   []byte("PATCH\x00\x00\x01\x00\x01\x08"),
+			wantErr: true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPatch(t, tt.patch, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestApplyUPS(t *testing.T) {
+	target := []byte{1, 2, 7, 4}
+
+	// skip 2 bytes then xor 3 with 4 to make 7
+	body := append([]byte("UPS1"), patchVarint(4)...)
+	body = append(body, patchVarint(4)...)
+	body = append(body, patchVarint(2)...)
+	body = append(body, 3^7, 0)
+
+	tests := []struct {
+		name    string
+		patch   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "valid", patch: patchFooter(body, patchTestROM, target), want: target},
+		{name: "wrong source", patch: patchFooter(body, []byte{9, 9, 9, 9}, target), wantErr: true},
+		{name: "wrong target", patch: patchFooter(body, patchTestROM, []byte{1, 2, 3, 4}), wantErr: true},
+		{name: "bad patch checksum", patch: corrupt(patchFooter(body, patchTestROM, target)), wantErr: true},
+		{name: "truncated hunk", patch: patchFooter(body[:len(body)-1], patchTestROM, target), wantErr: true},
+		{name: "truncated footer", patch: []byte("UPS1\x84\x84"), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPatch(t, tt.patch, tt.want, tt.wantErr)
+		})
+	}
+}
+
+func TestApplyBPS(t *testing.T) {
+	target := []byte{1, 2, 9, 9, 3, 4, 9, 9}
+
+	body := bpsHeader(4, 8)
+	body = append(body, bpsCommand(2, bpsSourceRead)...)
+	body = append(body, bpsCommand(2, bpsTargetRead)...)
+	body = append(body, 9, 9)
+	body = append(body, bpsCommand(2, bpsSourceCopy)...)
+	body = append(body, patchVarint(2<<1)...)
+	body = append(body, bpsCommand(2, bpsTargetCopy)...)
+	body = append(body, patchVarint(2<<1)...)
+
+	// a source copy from the largest positive offset
+	overflow := bpsHeader(4, 2)
+	overflow = append(overflow, bpsCommand(2, bpsSourceCopy)...)
+	overflow = append(overflow, patchVarint(math.MaxUint64-1)...)
+
+	// a target copy before anything has been written
+	earlyCopy := bpsHeader(4, 2)
+	earlyCopy = append(earlyCopy, bpsCommand(2, bpsTargetCopy)...)
+	earlyCopy = append(earlyCopy, patchVarint(0)...)
+
+	tests := []struct {
+		name    string
+		patch   []byte
+		want    []byte
+		wantErr bool
+	}{
+		{name: "valid", patch: patchFooter(body, patchTestROM, target), want: target},
+		{name: "wrong source", patch: patchFooter(body, []byte{9, 9, 9, 9}, target), wantErr: true},
+		{name: "wrong target", patch: patchFooter(body, patchTestROM, make([]byte, 8)), wantErr: true},
+		{name: "bad patch checksum", patch: corrupt(patchFooter(body, patchTestROM, target)), wantErr: true},
+		{name: "truncated command", patch: patchFooter(body[:len(body)-1], patchTestROM, target), wantErr: true},
+		{name: "truncated footer", patch: []byte("BPS1\x84\x88"), wantErr: true},
+		{name: "source offset overflow", patch: patchFooter(overflow, patchTestROM, target[:2]), wantErr: true},
+		{name: "target copy before write", patch: patchFooter(earlyCopy, patchTestROM, target[:2]), wantErr: true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			testPatch(t, tt.patch, tt.want, tt.wantErr)
+		})
+	}
+}
+
+// testPatch applies the patch to patchTestROM and checks the result, the rom
+// mustn't be changed either way.
+func testPatch(t *testing.T, patch, want []byte, wantErr bool) {
+	t.Helper()
+
+	rom := append([]byte(nil), patchTestROM...)
+	got, err := applyPatch(rom, patch)
+
+	if !bytes.Equal(rom, patchTestROM) {
+		t.Errorf("source rom changed to %v", rom)
+	}
+
+	if wantErr {
+		if err == nil {
+			t.Errorf("applyPatch() = %v, want an error", got)
+		}
+
+		return
+	}
+
+	if err != nil {
+		t.Fatalf("applyPatch() error: %v", err)
+	}
+
+	if !bytes.Equal(got, want) {
+		t.Errorf("applyPatch() = %v, want %v", got, want)
+	}
+}
+
+// ipsPatch wraps the records in the IPS magic and EOF marker.
+func ipsPatch(records ...[]byte) []byte {
+	patch := append([]byte(nil), ipsMagic...)
+	for _, r := range records {
+		patch = append(patch, r...)
+	}
+
+	return append(patch, ipsEOF...)
+}
+
+func bpsHeader(sourceSize, targetSize uint64) []byte {
+	h := append([]byte(nil), bpsMagic...)
+	h = append(h, patchVarint(sourceSize)...)
+	h = append(h, patchVarint(targetSize)...)
+
+	// no metadata
+	return append(h, patchVarint(0)...)
+}
+
+func bpsCommand(length int, action uint64) []byte {
+	return patchVarint(uint64(length-1)<<2 | action)
+}
+
+// patchVarint encodes v the way patchReader.varint reads it.
+func patchVarint(v uint64) []byte {
+	var b []byte
+	for {
+		x := byte(v & 0x7F)
+		v >>= 7
+		if v == 0 {
+			return append(b, x|0x80)
+		}
+
+		b = append(b, x)
+		v--
+	}
+}
+
+// patchFooter appends the UPS and BPS checksums of the source, the target and
+// the patch itself.
+func patchFooter(body, source, target []byte) []byte {
+	patch := append([]byte(nil), body...)
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(source))
+	patch = binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(target))
+
+	return binary.LittleEndian.AppendUint32(patch, crc32.ChecksumIEEE(patch))
+}
+
+// corrupt flips a bit in the patch checksum.
+func corrupt(patch []byte) []byte {
+	patch[len(patch)-1] ^= 1
+	return patch
+}
@@ -1,5 +1,11 @@
 package main
 
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
 const (
 	ScreenWidth  = 160
 	ScreenHeight = 144
@@ -14,70 +20,161 @@ const (
 	LCDC uint16 = 0xFF40 // LCD Control register
 	LY   uint16 = 0xFF44 // LCD Y coordinate
 	STAT uint16 = 0xFF41 // LCD status register
+	LYC  uint16 = 0xFF45 // LY compare
 
 	SCY uint16 = 0xFF42 // BG Viewport Y
 	SCX uint16 = 0xFF43 // BG Viewport X
 	WY  uint16 = 0xFF4A // Window Y
 	WX  uint16 = 0xFF4B // Window X
+
+	BGP  uint16 = 0xFF47 // BG palette data
+	OBP0 uint16 = 0xFF48 // OBJ palette 0 data
+	OBP1 uint16 = 0xFF49 // OBJ palette 1 data
 )
 
+// Renderer is the way the PPU draws the screen.
+type Renderer int
+
+const (
+	// RendererScanline draws each line in one go at the end of Mode3
+	RendererScanline Renderer = iota
+	// RendererFIFO draws a dot at a time with a pixel FIFO like the real PPU
+	RendererFIFO
+)
+
+var rendererNames = map[Renderer]string{
+	RendererScanline: "scanline",
+	RendererFIFO:     "fifo",
+}
+
+func (r Renderer) String() string {
+	if name, ok := rendererNames[r]; ok {
+		return name
+	}
+
+	return "unknown"
+}
+
+// Set implements flag.Value.
+func (r *Renderer) Set(name string) error {
+	for renderer, n := range rendererNames {
+		if strings.EqualFold(n, name) {
+			*r = renderer
+			return nil
+		}
+	}
+
+	return fmt.Errorf("unknown renderer: %s", name)
+}
+
 type PPU struct {
 	mem *Memory
 	cpu *CPU
 
 	dots int
+	// mode3Dots is how long Mode3 lasted on the current line, HBlank lasts
+	// for the rest of the 376 dots after the OAM scan
+	mode3Dots int
+
+	// lcdOn follows bit 7 of LCDC, hidden blanks the screen while the LCD is
+	// off and for the first frame after it is turned back on
+	lcdOn     bool
+	hidden    bool
+	skipFrame bool
+
+	// windowLine is the line of the window drawn next, it only moves on for
+	// lines the window is drawn on. wyTriggered is set once LY matches WY
+	windowLine  int
+	wyTriggered bool
+	// windowWrap is set when the window was started with WX at 166, which
+	// makes it span the whole of the next line
+	windowWrap bool
+
+	// statLine is the STAT interrupt line, the interrupt is only requested
+	// when it rises so sources which overlap block each other
+	statLine bool
+
+	// lineSprites holds the sprites found on the line by the OAM scan
+	lineSprites []oamSprite
+
+	// fifo is the pixel FIFO renderer, when nil the scanline renderer is used
+	fifo *fifoRenderer
 
 	frame [ScreenHeight][ScreenWidth][3]byte
 
 	// bgColourMap caches the background/window pixels on a scanline which use colour id 0
 	// so that sprites can be correctly drawn when they have the priority flag set
 	bgColourMap []bool
+	// bgPriorityMap caches the CGB background/window pixels on a scanline whose
+	// tile attributes give them priority over sprites
+	bgPriorityMap []bool
 }
 
-func NewPPU(cpu *CPU, mem *Memory) *PPU {
-	return &PPU{
-		mem:         mem,
-		cpu:         cpu,
-		bgColourMap: make([]bool, ScreenWidth),
+func NewPPU(cpu *CPU, mem *Memory, renderer Renderer) *PPU {
+	p := &PPU{
+		mem:           mem,
+		cpu:           cpu,
+		mode3Dots:     172,
+		hidden:        true,
+		lineSprites:   make([]oamSprite, 0, maxLineSprites),
+		bgColourMap:   make([]bool, ScreenWidth),
+		bgPriorityMap: make([]bool, ScreenWidth),
+	}
+
+	if renderer == RendererFIFO {
+		p.fifo = newFIFORenderer(p)
 	}
+
+	return p
 }
 
 // Update
 func (p *PPU) Update(cycles int) {
+	if !p.updateLCD() {
+		return
+	}
+
 	status := p.mem.Read(STAT)
 	mode := getMode(status)
 	line := p.getLine()
 
 	p.dots += cycles
 
-	if line == 144 {
-		p.setMode(status, Mode1)
-		mode = Mode1
-
-		if TestBit(status, 4) {
-			p.cpu.requestInterrupt(1)
-		}
-
-		p.cpu.requestInterrupt(0)
-	}
-
 	switch mode {
 	case Mode2:
 		if p.dots >= 80 {
-			p.setMode(status, Mode3)
+			p.setMode(Mode3)
 			p.dots = 0
+			p.startLine(line)
+
+			if p.fifo != nil {
+				p.fifo.start(line)
+			}
 		}
 
 	case Mode3:
 		// drawing
-		if p.dots >= 172 {
-			p.setMode(status, Mode0)
-			p.dots = 0
+		if p.fifo != nil {
+			for p.fifo.dots < p.dots && !p.fifo.done() {
+				p.fifo.tick()
+			}
 
-			if TestBit(status, 3) {
-				p.cpu.requestInterrupt(1)
+			if !p.fifo.done() {
+				break
 			}
 
+			p.fifo.finish()
+			p.mode3Dots = p.fifo.dots
+		} else if p.dots < p.mode3Dots {
+			break
+		}
+
+		p.setMode(Mode0)
+		p.dots -= p.mode3Dots
+
+		p.mem.hblankDMA()
+
+		if p.fifo == nil {
 			lcdc := p.mem.Read(LCDC)
 
 			p.RenderBackground(lcdc)
@@ -86,16 +183,26 @@ func (p *PPU) Update(cycles int) {
 			}
 
 			clear(p.bgColourMap)
+			clear(p.bgPriorityMap)
 		}
 
 	case Mode0:
-		if p.dots >= 204 {
+		if p.dots >= 376-p.mode3Dots {
 			p.dots = 0
 			p.setLine(line + 1)
-			p.setMode(status, Mode2)
 
-			if TestBit(status, 5) {
-				p.cpu.requestInterrupt(1)
+			if line+1 == ScreenHeight {
+				p.setMode(Mode1)
+				p.cpu.requestInterrupt(0)
+
+				// the first frame after the LCD is turned on isn't shown
+				if p.skipFrame {
+					p.skipFrame = false
+				} else {
+					p.hidden = false
+				}
+			} else {
+				p.setMode(Mode2)
 			}
 		}
 
@@ -105,49 +212,130 @@ func (p *PPU) Update(cycles int) {
 
 			if line == 153 {
 				p.setLine(0)
-				p.setMode(status, Mode2)
-
-				if TestBit(status, 5) {
-					p.cpu.requestInterrupt(1)
-				}
+				p.setMode(Mode2)
 			} else {
 				p.setLine(line + 1)
 			}
 		}
 	}
+
+	p.updateStat()
+}
+
+// startLine checks whether the window starts on the line, the window line
+// counter is reset at the start of each frame.
+func (p *PPU) startLine(line int) {
+	if line == 0 {
+		p.windowLine = 0
+		p.wyTriggered = false
+		p.windowWrap = false
+	}
+
+	if line == int(p.mem.Read(WY)) {
+		p.wyTriggered = true
+	}
+}
+
+// updateLCD turns the PPU on and off with bit 7 of LCDC and reports whether it is on.
+// While the LCD is off LY stays at 0 in mode 0, turning it on starts a new frame.
+func (p *PPU) updateLCD() bool {
+	on := TestBit(p.mem.Read(LCDC), 7)
+	if on == p.lcdOn {
+		return on
+	}
+
+	p.lcdOn = on
+	p.dots = 0
+	p.setLine(0)
+
+	if !on {
+		p.setMode(Mode0)
+		p.statLine = false
+		p.hidden = true
+		return false
+	}
+
+	p.setMode(Mode2)
+	p.skipFrame = true
+
+	return true
+}
+
+// updateStat sets the LY=LYC flag and requests the STAT interrupt when the
+// interrupt line rises. The line is the OR of the sources enabled in STAT so
+// a source can't cause an interrupt while another is holding the line high.
+func (p *PPU) updateStat() {
+	stat := p.mem.io[STAT-NotUsable]
+
+	if p.mem.Read(LY) == p.mem.Read(LYC) {
+		stat = SetBit(stat, 2)
+	} else {
+		stat = ResetBit(stat, 2)
+	}
+
+	p.mem.io[STAT-NotUsable] = stat
+
+	mode := getMode(stat)
+	line := (mode == Mode0 && TestBit(stat, 3)) ||
+		(mode == Mode1 && TestBit(stat, 4)) ||
+		(mode == Mode2 && TestBit(stat, 5)) ||
+		(TestBit(stat, 2) && TestBit(stat, 6))
+
+	if line && !p.statLine {
+		p.cpu.requestInterrupt(1)
+	}
+
+	p.statLine = line
 }
 
 func (p *PPU) RenderBackground(control byte) {
 	// get the tile offset that we should be using
-	scx := p.mem.Read(SCX)
-	scy := p.mem.Read(SCY)
-	wx := p.mem.Read(WX) - 7
-	wy := p.mem.Read(WY)
+	scx := int(p.mem.Read(SCX))
+	scy := int(p.mem.Read(SCY))
+	wx := int(p.mem.Read(WX))
 
 	currentLine := p.getLine()
-	inWindow := p.inWindow(control, int(wy), currentLine)
-	tileDataAddr := p.getTileDataAddress(control)
-	tileMapAddr := p.getTileMapAddress(control, inWindow)
-	palette := p.mem.Read(0xFF47)
+	cgb := p.mem.cgbMode
+
+	// on the DMG clearing bit 0 blanks the background and window, on the CGB
+	// it takes away their priority over sprites instead
+	if !cgb && !TestBit(control, 0) {
+		for pixel := 0; pixel < ScreenWidth; pixel++ {
+			p.RenderPixel(0, 0, &p.mem.bgPalettes, 0, pixel, currentLine)
+			p.bgColourMap[pixel] = true
+		}
 
-	// set current x and y position considering scroll
-	yPos := (currentLine + int(scy)) % 256
-	if inWindow {
-		yPos = currentLine - int(wy)
+		return
 	}
 
-	tileYOffset := uint16(yPos/8) * 32
-
-	for pixel := byte(0); pixel < ScreenWidth; pixel++ {
-		xPos := uint16(pixel+scx) % 256
-		if inWindow && pixel >= wx {
-			xPos = uint16(pixel - wx)
+	window := p.windowVisible(control, wx)
+	tileDataAddr := p.getTileDataAddress(control)
+	bgMapAddr := p.getTileMapAddress(control, false)
+	windowMapAddr := p.getTileMapAddress(control, true)
+	palette := p.mem.Read(BGP)
+
+	// set current y position considering scroll
+	bgY := (currentLine + scy) % 256
+
+	for pixel := 0; pixel < ScreenWidth; pixel++ {
+		tileMapAddr := bgMapAddr
+		xPos := (pixel + scx) % 256
+		yPos := bgY
+
+		if col := p.windowColumn(pixel, wx, scx); window && col >= 0 {
+			tileMapAddr = windowMapAddr
+			xPos = col
+			yPos = p.windowLine
 		}
 
-		tileXOffset := xPos / 8
+		tileNumAddr := tileMapAddr + uint16(yPos/8)*32 + uint16(xPos/8)
+		tileNum := p.mem.readVRAM(0, tileNumAddr)
 
-		tileNumAddr := tileMapAddr + tileYOffset + tileXOffset
-		tileNum := p.mem.Read(tileNumAddr)
+		// the CGB keeps the attributes of each tile in the map in VRAM bank 1
+		var attr byte
+		if cgb {
+			attr = p.mem.readVRAM(1, tileNumAddr)
+		}
 
 		var tileAddr uint16
 		if tileDataAddr == 0x9000 {
@@ -157,114 +345,184 @@ func (p *PPU) RenderBackground(control byte) {
 		}
 
 		// read correct two bytes based on current line
-		yOffset := (yPos % 8) * 2
+		tileY := yPos % 8
+		if TestBit(attr, 6) {
+			tileY = 7 - tileY
+		}
+
 		xOffset := 7 - (xPos % 8)
+		if TestBit(attr, 5) {
+			xOffset = xPos % 8
+		}
 
-		d1 := p.mem.Read(tileAddr + uint16(yOffset))
-		d2 := p.mem.Read(tileAddr + uint16(yOffset) + 1)
+		bank := int(attr>>3) & 0x1
+		d1 := p.mem.readVRAM(bank, tileAddr+uint16(tileY*2))
+		d2 := p.mem.readVRAM(bank, tileAddr+uint16(tileY*2)+1)
 
 		colourID := toColourID(d1, d2, byte(xOffset))
 
-		p.RenderPixel(colourID, palette, int(pixel), currentLine)
+		if cgb {
+			p.RenderColourPixel(colourID, attr&0x7, &p.mem.bgPalettes, int(pixel), currentLine)
+		} else {
+			p.RenderPixel(colourID, palette, &p.mem.bgPalettes, 0, int(pixel), currentLine)
+		}
 
 		p.bgColourMap[pixel] = colourID == 0
+		p.bgPriorityMap[pixel] = TestBit(attr, 7)
 	}
+
+	if window {
+		p.windowLine++
+	}
+
+	p.windowWrap = window && wx == 166
 }
 
 func (p *PPU) RenderSprites(control byte) {
 	currentLine := p.getLine()
-	pal1 := p.mem.Read(0xFF48)
-	pal2 := p.mem.Read(0xFF49)
-
-	size := 8
-	if TestBit(control, 2) {
-		size = 16
+	pal1 := p.mem.Read(OBP0)
+	pal2 := p.mem.Read(OBP1)
+	cgb := p.mem.cgbMode
+
+	// on the CGB clearing bit 0 draws sprites over the background regardless of priority
+	bgPriority := !cgb || TestBit(control, 0)
+
+	size := p.spriteHeight(control)
+	sprites := p.scanOAM(currentLine, size)
+
+	// on the DMG the sprite with the lowest x wins and ties go to the one
+	// earliest in OAM, on the CGB it's only the OAM order
+	if !cgb {
+		sort.SliceStable(sprites, func(i, j int) bool {
+			return sprites[i].x < sprites[j].x
+		})
 	}
 
-	var spriteXPositions [ScreenWidth]int
-
-	// loop over all 40 sprites, check which sprites are to be rendered
-	spriteLimit := 0
-	for i := uint16(0); i < 40; i++ {
-		addr := i * 4
+	// drawn marks the pixels which already have a sprite, a sprite that is
+	// hidden behind the background still hides the sprites below it
+	var drawn [ScreenWidth]bool
 
-		// read the sprite into memory
-		yPos := int16(p.mem.Read(0xFE00+addr)) - 16
-		xPos := p.mem.Read(0xFE00+addr+1) - 8
-		tileIdx := p.mem.Read(0xFE00 + addr + 2)
-		flags := p.mem.Read(0xFE00 + addr + 3)
+	for _, s := range sprites {
+		xFlip := TestBit(s.flags, 5)
+		yFlip := TestBit(s.flags, 6)
+		priority := TestBit(s.flags, 7)
 
-		// check if the sprite should be rendered
-		if currentLine < int(yPos) || currentLine >= int(yPos)+size {
-			continue
+		// get the line of the sprite tile that we need to render
+		line := currentLine + 16 - s.y
+		if yFlip {
+			line = size - line - 1
 		}
 
-		spriteLimit++
-		if spriteLimit > 10 {
-			break
+		// 8x16 sprites use a pair of tiles starting at an even tile
+		tile := s.tile
+		if size == 16 {
+			tile &= 0xFE
 		}
 
-		xFlip := TestBit(flags, 5)
-		yFlip := TestBit(flags, 6)
-		priority := TestBit(flags, 7)
-
-		// get the line of the sprite tile that we need to render
-		line := currentLine - int(yPos)
-		if yFlip {
-			line = size - line - 1
+		bank := 0
+		if cgb {
+			bank = int(s.flags>>3) & 0x1
 		}
 
-		dataAddr := 0x8000 + (uint16(tileIdx) * 16) + uint16(line*2)
-		d1 := p.mem.Read(dataAddr)
-		d2 := p.mem.Read(dataAddr + 1)
+		dataAddr := 0x8000 + (uint16(tile) * 16) + uint16(line*2)
+		d1 := p.mem.readVRAM(bank, dataAddr)
+		d2 := p.mem.readVRAM(bank, dataAddr+1)
 
-		// draw the tile line
-		for tilePixel := byte(0); tilePixel < 8; tilePixel++ {
-			x := xPos + (7 - tilePixel)
-			if xFlip {
-				x = xPos + tilePixel
+		// draw the tile line, clipping pixels which are off screen
+		for tilePixel := 0; tilePixel < 8; tilePixel++ {
+			x := s.x - 8 + tilePixel
+			if x < 0 || x >= ScreenWidth || drawn[x] {
+				continue
 			}
 
-			if x >= ScreenWidth {
-				continue
+			bit := byte(7 - tilePixel)
+			if xFlip {
+				bit = byte(tilePixel)
 			}
 
-			// check the sprite priority of the current pixel
-			if spriteXPositions[x] != 0 && spriteXPositions[x] <= int(xPos)+1 {
+			colourID := toColourID(d1, d2, bit)
+			if colourID == 0 {
 				continue
 			}
 
+			drawn[x] = true
+
 			// if we have bg priority flag set and the colour id of current pixel in the background
 			// is not colour id 0 then we skip this as we are drawing sprites below the bg
-			if priority && !p.bgColourMap[x] {
+			if bgPriority && (priority || p.bgPriorityMap[x]) && !p.bgColourMap[x] {
 				continue
 			}
 
-			colourID := toColourID(d1, d2, tilePixel)
-			if colourID == 0 {
-				continue
+			if cgb {
+				p.RenderColourPixel(colourID, s.flags&0x7, &p.mem.objPalettes, x, currentLine)
+			} else if TestBit(s.flags, 4) {
+				p.RenderPixel(colourID, pal2, &p.mem.objPalettes, 1, x, currentLine)
+			} else {
+				p.RenderPixel(colourID, pal1, &p.mem.objPalettes, 0, x, currentLine)
 			}
+		}
+	}
+}
 
-			pal := pal1
-			if TestBit(flags, 4) {
-				pal = pal2
-			}
+// scanOAM finds the first 10 sprites in OAM which are on the line, like the
+// OAM scan in Mode2. Sprites count towards the limit even when their x
+// position puts them off screen.
+func (p *PPU) scanOAM(line, size int) []oamSprite {
+	p.lineSprites = p.lineSprites[:0]
 
-			p.RenderPixel(colourID, pal, int(x), currentLine)
+	for i := 0; i < 40 && len(p.lineSprites) < maxLineSprites; i++ {
+		sprite := p.mem.oam[i*4 : i*4+4]
+		y := int(sprite[0])
 
-			spriteXPositions[x] = int(xPos + 1) // add one here to use 0 as empty value
+		if line+16 < y || line+16 >= y+size {
+			continue
 		}
+
+		p.lineSprites = append(p.lineSprites, oamSprite{
+			y:     y,
+			x:     int(sprite[1]),
+			tile:  sprite[2],
+			flags: sprite[3],
+			index: i,
+		})
 	}
+
+	return p.lineSprites
 }
 
-func (p *PPU) RenderPixel(colourID byte, palette byte, x int, y int) {
+// spriteHeight returns the height of the sprites set by bit 2 of LCDC.
+func (p *PPU) spriteHeight(control byte) int {
+	if TestBit(control, 2) {
+		return 16
+	}
+
+	return 8
+}
+
+// RenderPixel draws a pixel coloured with a DMG palette. DMG games on CGB
+// hardware have each shade coloured by the compatibility palette given by
+// palettes and index, which is filled in by the boot rom.
+func (p *PPU) RenderPixel(colourID byte, palette byte, palettes *colourPalettes, index byte, x int, y int) {
 	colour := (palette >> (colourID * 2) & 0x3)
 
+	if p.mem.model == ModelCGB {
+		r, g, b := palettes.colour(index, colour)
+		p.DrawPixel(x, y, r, g, b)
+		return
+	}
+
 	r, g, b := toScreenColour(colour)
 
 	p.DrawPixel(x, y, r, g, b)
 }
 
+// RenderColourPixel draws a pixel coloured with a CGB palette.
+func (p *PPU) RenderColourPixel(colourID byte, palette byte, palettes *colourPalettes, x int, y int) {
+	r, g, b := palettes.colour(palette, colourID)
+
+	p.DrawPixel(x, y, r, g, b)
+}
+
 func (p *PPU) DrawPixel(x, y int, r, g, b byte) {
 	p.frame[y][x][0] = r
 	p.frame[y][x][1] = g
@@ -296,8 +554,30 @@ func (p *PPU) getTileDataAddress(control byte) uint16 {
 	return base
 }
 
-func (p *PPU) inWindow(control byte, wy int, line int) bool {
-	return TestBit(control, 5) && line >= wy
+// windowVisible reports whether the window is drawn on the current line. The
+// window is drawn once LY has matched WY during the frame and WX is on screen,
+// or the window wrapped around from the line before.
+func (p *PPU) windowVisible(control byte, wx int) bool {
+	return TestBit(control, 5) && p.wyTriggered && (wx <= 166 || p.windowWrap)
+}
+
+// windowColumn returns the column of the window drawn at screen x, which is
+// negative before the window starts. The window starts at WX-7 so when WX is
+// below 7 its first pixels are off the left of the screen. WX of 0 matches
+// before the fine scroll of SCX has been thrown away, so the window is moved
+// a further SCX&7 pixels to the left. After a line where the window started
+// with WX at 166 the window spans the whole of the next line.
+func (p *PPU) windowColumn(x, wx, scx int) int {
+	if p.windowWrap {
+		return x
+	}
+
+	col := x + 7 - wx
+	if wx == 0 {
+		col += scx & 0x7
+	}
+
+	return col
 }
 
 func toColourID(d1, d2, pixel byte) byte {
@@ -323,9 +603,23 @@ func getMode(stat byte) byte {
 	return (stat & 0x3)
 }
 
-func (p *PPU) setMode(stat byte, mode byte) {
-	s := (stat & 0xFC) | mode
-	p.mem.Write(STAT, s)
+// vramAccessible reports whether the cpu can access VRAM, it is locked while
+// the PPU is drawing.
+func (p *PPU) vramAccessible() bool {
+	return !p.lcdOn || getMode(p.mem.io[STAT-NotUsable]) != Mode3
+}
+
+// oamAccessible reports whether the cpu can access OAM, it is locked during
+// the OAM scan and while the PPU is drawing.
+func (p *PPU) oamAccessible() bool {
+	mode := getMode(p.mem.io[STAT-NotUsable])
+	return !p.lcdOn || (mode != Mode2 && mode != Mode3)
+}
+
+// setMode sets the mode bits of STAT, which the cpu can't write.
+func (p *PPU) setMode(mode byte) {
+	stat := &p.mem.io[STAT-NotUsable]
+	*stat = *stat&0xFC | mode
 }
 
 func (p *PPU) getLine() int {
@@ -338,6 +632,16 @@ func (p *PPU) setLine(line int) {
 
 func (p *PPU) frameBufferToBytes() []byte {
 	frame := make([]byte, 0, 4*ScreenHeight*ScreenWidth)
+
+	// the screen is white while the LCD is off
+	if p.hidden {
+		for i := 0; i < cap(frame); i++ {
+			frame = append(frame, 0xFF)
+		}
+
+		return frame
+	}
+
 	for y := 0; y < ScreenHeight; y++ {
 		for x := 0; x < ScreenWidth; x++ {
 			frame = append(frame, p.frame[y][x][0])
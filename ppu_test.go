@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Test roms aren't kept in the repo, copy them into testdata/roms to run
+// these tests. Each rom needs its expected screenshot next to it with the
+// same name and a .png extension, when the screen doesn't match it is saved
+// next to the rom as well.
+const (
+	testROMDir = "testdata/roms"
+
+	// testROMFrames is how long each rom runs before the screen is compared,
+	// long enough for all of the supported test roms to finish
+	testROMFrames = 120
+)
+
+// referenceShades and screenShades are the greys used for the four DMG
+// shades by the expected screenshots and by the emulator.
+var (
+	referenceShades = [4]uint8{0xFF, 0xAA, 0x55, 0x00}
+	screenShades    = [4]uint8{0xFF, 0xC0, 0x60, 0x00}
+)
+
+func TestDMGAcid2(t *testing.T) {
+	for _, renderer := range []Renderer{RendererScanline, RendererFIFO} {
+		t.Run(renderer.String(), func(t *testing.T) {
+			testScreenshot(t, filepath.Join(testROMDir, "dmg-acid2.gb"), renderer)
+		})
+	}
+}
+
+// TestMealybug runs the mealybug tearoom tests, which change PPU registers
+// part way through a line so they are only drawn right by the pixel FIFO.
+func TestMealybug(t *testing.T) {
+	roms, _ := filepath.Glob(filepath.Join(testROMDir, "mealybug", "*.gb"))
+	if len(roms) == 0 {
+		t.Skip("no mealybug test roms in", filepath.Join(testROMDir, "mealybug"))
+	}
+
+	for _, rom := range roms {
+		t.Run(strings.TrimSuffix(filepath.Base(rom), ".gb"), func(t *testing.T) {
+			testScreenshot(t, rom, RendererFIFO)
+		})
+	}
+}
+
+func TestWindowWX(t *testing.T) {
+	tests := []struct {
+		name    string
+		wx, scx byte
+		line    int
+		// first is where the first dark column of the window is drawn, every
+		// 8th pixel after it is dark as well
+		first int
+	}{
+		{name: "WX 7", wx: 7, scx: 3, line: 20, first: 0},
+		{name: "WX 20", wx: 20, line: 20, first: 13},
+		{name: "WX 3", wx: 3, scx: 3, line: 20, first: 4},
+		// WX 0 matches before the fine scroll is thrown away
+		{name: "WX 0", wx: 0, line: 20, first: 1},
+		{name: "WX 0 SCX 3", wx: 0, scx: 3, line: 20, first: 6},
+		// the window starts on the last pixel and spans the whole next line
+		{name: "WX 166", wx: 166, line: 16, first: 159},
+		{name: "WX 166 next line", wx: 166, line: 17, first: 0},
+	}
+
+	for _, renderer := range []Renderer{RendererScanline, RendererFIFO} {
+		for _, tt := range tests {
+			t.Run(renderer.String()+"/"+tt.name, func(t *testing.T) {
+				p := renderWindow(renderer, tt.wx, tt.scx)
+
+				for x := 0; x < ScreenWidth; x++ {
+					want := x >= tt.first && (x-tt.first)%8 == 0
+					if got := p.frame[tt.line][x][0] == 0; got != want {
+						t.Errorf("pixel %d on line %d is dark %v, want %v", x, tt.line, got, want)
+					}
+				}
+			})
+		}
+	}
+}
+
+// renderWindow draws a frame with a blank background and the window from
+// line 16, whose tiles have a dark first column.
+func renderWindow(renderer Renderer, wx, scx byte) *PPU {
+	mem := NewMemory(ModelDMG)
+	cpu := NewCPU(mem)
+	p := NewPPU(cpu, mem, renderer)
+	mem.cpu = cpu
+	mem.ppu = p
+
+	// tile 1 has a dark first column, the window map at 0x9C00 uses it
+	for row := 0; row < 8; row++ {
+		mem.vram[0][0x10+2*row] = 0x80
+		mem.vram[0][0x11+2*row] = 0x80
+	}
+
+	for i := 0; i < 0x400; i++ {
+		mem.vram[0][0x1C00+i] = 1
+	}
+
+	mem.Write(BGP, 0xE4)
+	mem.Write(SCX, scx)
+	mem.Write(WY, 16)
+	mem.Write(WX, wx)
+	mem.Write(LCDC, 0xF1)
+
+	for i := 0; i < CyclesPerFrame; i += 4 {
+		p.Update(4)
+	}
+
+	return p
+}
+
+// testScreenshot runs the rom on a DMG and compares the screen with the
+// expected screenshot, skipping the test when the rom isn't there.
+func testScreenshot(t *testing.T, rom string, renderer Renderer) {
+	t.Helper()
+
+	if _, err := os.Stat(rom); err != nil {
+		t.Skip("test rom not found:", rom)
+	}
+
+	want, err := readScreenshot(strings.TrimSuffix(rom, filepath.Ext(rom)) + ".png")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	gb, err := NewGameboy(rom, Options{Model: ModelDMG, Renderer: renderer})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < testROMFrames; i++ {
+		gb.Update()
+		gb.AudioSamples()
+	}
+
+	frame := gb.GetRenderedFrame()
+
+	var diffs int
+	var first image.Point
+	for y := 0; y < ScreenHeight; y++ {
+		for x := 0; x < ScreenWidth; x++ {
+			got := nearestShade(screenShades, frame[4*(y*ScreenWidth+x)])
+			if got == want[y][x] {
+				continue
+			}
+
+			if diffs == 0 {
+				first = image.Pt(x, y)
+			}
+
+			diffs++
+		}
+	}
+
+	if diffs == 0 {
+		return
+	}
+
+	out := strings.TrimSuffix(rom, filepath.Ext(rom)) + "-actual.png"
+	if err := writeScreenshot(out, frame); err != nil {
+		t.Log(err)
+	}
+
+	t.Errorf("%d pixels differ, the first at %d,%d, the screen was saved to %s", diffs, first.X, first.Y, out)
+}
+
+// readScreenshot reads the shade of each pixel of an expected screenshot.
+func readScreenshot(path string) (shades [ScreenHeight][ScreenWidth]int, err error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return shades, err
+	}
+	defer f.Close()
+
+	img, err := png.Decode(f)
+	if err != nil {
+		return shades, err
+	}
+
+	if size := img.Bounds().Size(); size.X != ScreenWidth || size.Y != ScreenHeight {
+		return shades, fmt.Errorf("%s is %dx%d, want %dx%d", path, size.X, size.Y, ScreenWidth, ScreenHeight)
+	}
+
+	origin := img.Bounds().Min
+	for y := 0; y < ScreenHeight; y++ {
+		for x := 0; x < ScreenWidth; x++ {
+			grey := color.GrayModel.Convert(img.At(origin.X+x, origin.Y+y)).(color.Gray)
+			shades[y][x] = nearestShade(referenceShades, grey.Y)
+		}
+	}
+
+	return shades, nil
+}
+
+// nearestShade returns the shade in shades which is closest to the grey level v.
+func nearestShade(shades [4]uint8, v uint8) int {
+	best := 0
+	for i, s := range shades {
+		if absDiff(s, v) < absDiff(shades[best], v) {
+			best = i
+		}
+	}
+
+	return best
+}
+
+func absDiff(a, b uint8) uint8 {
+	if a > b {
+		return a - b
+	}
+
+	return b - a
+}
+
+// writeScreenshot saves a frame from GetRenderedFrame as a PNG.
+func writeScreenshot(path string, frame []byte) error {
+	img := image.NewRGBA(image.Rect(0, 0, ScreenWidth, ScreenHeight))
+	copy(img.Pix, frame)
+
+	f, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	if err := png.Encode(f, img); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -22,16 +22,11 @@ type Registers struct {
 	l byte
 }
 
+// NewRegisters returns the registers at power on, the boot rom or SkipBoot
+// sets them to the values games expect.
 func NewRegisters() *Registers {
 	return &Registers{
-		a: 0x01,
-		b: 0x00,
-		c: 0x13,
-		d: 0x00,
-		e: 0xd8,
-		h: 0x01,
-		l: 0x4d,
-		f: flagsFromByte(0xB0),
+		f: flagsFromByte(0x00),
 	}
 }
 
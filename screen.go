@@ -2,6 +2,10 @@ package main
 
 import (
 	"fmt"
+	"log"
+	"path/filepath"
+	"strings"
+	"time"
 
 	"github.com/hajimehoshi/ebiten/v2"
 	"github.com/hajimehoshi/ebiten/v2/ebitenutil"
@@ -9,39 +13,113 @@ import (
 )
 
 type Game struct {
-	gb *Gameboy
+	gb      *Gameboy
+	romPath string
 
 	width  int
 	height int
 
 	img *ebiten.Image
+
+	audio *AudioStream
+	// frames is how many Gameboy frames are owed, the Gameboy runs slightly
+	// slower than the ticks so a tick is skipped every few seconds
+	frames float64
 }
 
-func NewGame(w, h int, romPath string) *Game {
-	gb, err := NewGameboy(romPath)
+// TPS is how many times a second the game is updated
+const TPS = 60
+
+func NewGame(w, h int, romPath string, opts Options) *Game {
+	gb, err := NewGameboy(romPath, opts)
 	if err != nil {
 		panic(err)
 	}
 
-	ebiten.SetTPS(60)
+	ebiten.SetTPS(TPS)
 	ebiten.SetVsyncEnabled(false)
 
+	stream, err := NewAudioStream(gb.SampleRate())
+	if err != nil {
+		// the game is still playable without sound
+		log.Println("audio error:", err)
+	}
+
 	return &Game{
-		width:  w,
-		height: h,
-		img:    ebiten.NewImage(w, h),
-		gb:     gb,
+		width:   w,
+		height:  h,
+		img:     ebiten.NewImage(w, h),
+		gb:      gb,
+		romPath: romPath,
+		audio:   stream,
 	}
 }
 
 func (g *Game) Update() error {
 	p, r := Buttons()
 	g.gb.UpdateButtons(p, r)
-	g.gb.Update()
+	g.gb.SetTilt(Tilt())
+	g.updateSoundKeys()
+
+	g.frames += FrameRate / TPS
+	for ; g.frames >= 1; g.frames-- {
+		g.gb.Update()
+	}
+
+	samples := g.gb.AudioSamples()
+	if g.audio != nil {
+		g.audio.Push(samples)
+	}
 
 	return nil
 }
 
+// channelKeys toggle the sound channels, holding shift solos the channel instead
+var channelKeys = []ebiten.Key{ebiten.KeyDigit1, ebiten.KeyDigit2, ebiten.KeyDigit3, ebiten.KeyDigit4}
+
+// updateSoundKeys handles the hotkeys for muting channels and recording
+// the audio. F9 starts and stops recording, with shift held each channel is
+// recorded to its own file as well.
+func (g *Game) updateSoundKeys() {
+	shift := ebiten.IsKeyPressed(ebiten.KeyShift)
+
+	for i, key := range channelKeys {
+		if !inpututil.IsKeyJustPressed(key) {
+			continue
+		}
+
+		ch := Channels(1 << i)
+		switch {
+		case shift && g.gb.Heard() == ch:
+			g.gb.SetHeard(AllChannels)
+		case shift:
+			g.gb.SetHeard(ch)
+		default:
+			g.gb.SetHeard(g.gb.Heard() ^ ch)
+		}
+	}
+
+	if !inpututil.IsKeyJustPressed(ebiten.KeyF9) {
+		return
+	}
+
+	if g.gb.Recording() {
+		if err := g.gb.StopRecording(); err != nil {
+			log.Println("recording error:", err)
+		}
+
+		return
+	}
+
+	path := strings.TrimSuffix(g.romPath, filepath.Ext(g.romPath)) + time.Now().Format("-20060102-150405") + ".wav"
+	if err := g.gb.StartRecording(path, shift); err != nil {
+		log.Println("recording error:", err)
+		return
+	}
+
+	log.Println("recording audio to", path)
+}
+
 func (g *Game) Draw(screen *ebiten.Image) {
 	screen.WritePixels(g.gb.GetRenderedFrame())
 	ebitenutil.DebugPrint(screen, fmt.Sprintf("fps: %.2f\ntps: %.2f", ebiten.ActualFPS(), ebiten.ActualTPS()))
@@ -79,3 +157,29 @@ func Buttons() ([]Button, []Button) {
 
 	return p, r
 }
+
+// tiltKeys maps keys to the direction they tilt the Gameboy for cartridges with an accelerometer
+var tiltKeys = map[ebiten.Key][2]float64{
+	ebiten.KeyW: {0, -1},
+	ebiten.KeyS: {0, 1},
+	ebiten.KeyA: {-1, 0},
+	ebiten.KeyD: {1, 0},
+}
+
+// Tilt returns how far the Gameboy is tilted in g. While the left mouse button is held the
+// tilt follows the cursor position relative to the centre of the screen, otherwise it comes from the keyboard.
+func Tilt() (x, y float64) {
+	if ebiten.IsMouseButtonPressed(ebiten.MouseButtonLeft) {
+		cx, cy := ebiten.CursorPosition()
+		return float64(cx-ScreenWidth/2) / (ScreenWidth / 2), float64(cy-ScreenHeight/2) / (ScreenHeight / 2)
+	}
+
+	for key, dir := range tiltKeys {
+		if ebiten.IsKeyPressed(key) {
+			x += dir[0]
+			y += dir[1]
+		}
+	}
+
+	return x, y
+}
@@ -0,0 +1,181 @@
+package main
+
+import (
+	"log"
+)
+
+const (
+	// serialBitCycles is how long the internal clock takes to shift a bit at
+	// 8192Hz, the CGB fast clock runs at 262144Hz
+	serialBitCycles     = 512
+	serialFastBitCycles = 16
+)
+
+// Serial is the serial port, which can be connected to another emulator by a Link.
+//
+// Transfers are exchanged a byte at a time. When the Gameboy using the
+// internal clock starts a transfer its byte is sent to the peer, which swaps
+// it for the byte in its own SB and sends that back. The transfer finishes
+// once both its clock has run out and the reply has arrived, so a slow peer
+// only holds up the transfer and never the emulator. With no peer the cable
+// is disconnected, the transfer reads 0xFF and transfers using the external
+// clock never finish.
+type Serial struct {
+	mem *Memory
+	cpu *CPU
+
+	link *Link
+
+	sb byte
+	sc byte
+
+	// timer counts down the cycles left in a transfer using the internal clock,
+	// it finishes once the timer has run out and the peer has replied
+	active   bool
+	timer    int
+	replied  bool
+	received byte
+}
+
+func NewSerial(cpu *CPU, mem *Memory) *Serial {
+	return &Serial{
+		cpu: cpu,
+		mem: mem,
+	}
+}
+
+func (s *Serial) Read(addr uint16) byte {
+	if addr == SB {
+		return s.sb
+	}
+
+	// the clock speed bit is only on the CGB
+	if s.mem.cgbMode {
+		return s.sc | 0x7C
+	}
+
+	return s.sc | 0x7E
+}
+
+func (s *Serial) Write(addr uint16, val byte) {
+	if addr == SB {
+		s.sb = val
+		return
+	}
+
+	s.sc = val
+
+	// a transfer with the external clock waits for the peer to start it
+	if !TestBit(val, 7) || !TestBit(val, 0) {
+		s.active = false
+		return
+	}
+
+	s.active = true
+	s.timer = 8 * s.bitCycles()
+	s.replied = s.link == nil || !s.link.Connected()
+	s.received = 0xFF
+
+	if !s.replied {
+		s.link.Send(linkFrame{transfer: true, data: s.sb})
+	}
+}
+
+// bitCycles is how long the internal clock takes to shift a bit. The clock
+// comes from the cpu so it is twice as fast in double speed.
+func (s *Serial) bitCycles() int {
+	cycles := serialBitCycles
+	if s.mem.cgbMode && TestBit(s.sc, 1) {
+		cycles = serialFastBitCycles
+	}
+
+	if s.cpu.doubleSpeed {
+		cycles /= 2
+	}
+
+	return cycles
+}
+
+// Update runs the serial port for the given number of cycles and handles
+// what the peer has sent since the last update.
+func (s *Serial) Update(cycles int) {
+	if s.active {
+		s.timer -= cycles
+	}
+
+	if s.link != nil {
+		s.poll()
+	}
+
+	// the peer is still connected but has stopped answering
+	if s.active && !s.replied && s.timer <= -linkReplyCycles {
+		log.Println("link cable peer stopped replying")
+		s.Close()
+		s.replied = true
+	}
+
+	if s.active && s.timer <= 0 && s.replied {
+		s.finish(s.received)
+	}
+}
+
+// poll handles the frames the peer has sent without waiting for more.
+func (s *Serial) poll() {
+	for {
+		select {
+		case in, ok := <-s.link.in:
+			if !ok {
+				log.Println("link cable disconnected")
+				s.Close()
+
+				// the rest of the transfer reads a disconnected cable
+				s.replied = true
+				return
+			}
+
+			s.receive(in)
+
+		default:
+			return
+		}
+	}
+}
+
+func (s *Serial) receive(in linkFrame) {
+	if in.reply && s.active && !s.replied {
+		s.received = in.replyData
+		s.replied = true
+	}
+
+	if in.transfer {
+		reply := linkFrame{reply: true, replyData: 0xFF}
+
+		// only a transfer waiting on the external clock takes the byte
+		if TestBit(s.sc, 7) && !TestBit(s.sc, 0) {
+			reply.replyData = s.sb
+			s.finish(in.data)
+		}
+
+		s.link.Send(reply)
+	}
+}
+
+// finish completes the transfer, putting the byte shifted in into SB.
+func (s *Serial) finish(received byte) {
+	s.sb = received
+	s.sc = ResetBit(s.sc, 7)
+	s.active = false
+	s.cpu.requestInterrupt(3)
+}
+
+// Close disconnects the link cable.
+func (s *Serial) Close() error {
+	if s.link == nil {
+		return nil
+	}
+
+	err := s.link.Close()
+	s.link = nil
+
+	return err
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// newLinkedSerials returns two serial ports connected by a link cable.
+func newLinkedSerials() (*Serial, *Serial) {
+	conn, peer := net.Pipe()
+
+	return newTestSerial(conn), newTestSerial(peer)
+}
+
+func newTestSerial(conn net.Conn) *Serial {
+	mem := NewMemory(ModelDMG)
+	cpu := NewCPU(mem)
+	mem.cpu = cpu
+
+	s := NewSerial(cpu, mem)
+	s.link = newLink()
+	s.link.start(conn)
+
+	return s
+}
+
+// runSerial updates the serial ports until done reports true, the peers run
+// on their own goroutines so it waits for them in real time.
+func runSerial(t *testing.T, done func() bool, serials ...*Serial) {
+	t.Helper()
+
+	deadline := time.Now().Add(5 * time.Second)
+	for !done() {
+		if time.Now().After(deadline) {
+			t.Fatal("timed out")
+		}
+
+		for _, s := range serials {
+			s.Update(serialBitCycles)
+		}
+
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestSerialTransfer(t *testing.T) {
+	master, slave := newLinkedSerials()
+	defer master.Close()
+	defer slave.Close()
+
+	slave.Write(SB, 0x42)
+	slave.Write(SC, 0x80)
+	master.Write(SB, 0x17)
+	master.Write(SC, 0x81)
+
+	runSerial(t, func() bool {
+		return !TestBit(master.sc, 7) && !TestBit(slave.sc, 7)
+	}, master, slave)
+
+	if master.sb != 0x42 {
+		t.Errorf("internal clock side received %#02x, want 0x42", master.sb)
+	}
+
+	if slave.sb != 0x17 {
+		t.Errorf("external clock side received %#02x, want 0x17", slave.sb)
+	}
+
+	for _, s := range []*Serial{master, slave} {
+		if !TestBit(s.mem.Read(InterruptFlagReg), 3) {
+			t.Errorf("serial interrupt not requested, IF is %#02x", s.mem.Read(InterruptFlagReg))
+		}
+	}
+}
+
+func TestSerialNoPeerTransfer(t *testing.T) {
+	master, slave := newLinkedSerials()
+	defer master.Close()
+	defer slave.Close()
+
+	// the peer isn't waiting for a transfer so it replies 0xFF and keeps its byte
+	slave.Write(SB, 0x42)
+	master.Write(SB, 0x17)
+	master.Write(SC, 0x81)
+
+	runSerial(t, func() bool { return !TestBit(master.sc, 7) }, master, slave)
+
+	if master.sb != 0xFF {
+		t.Errorf("internal clock side received %#02x, want 0xff", master.sb)
+	}
+
+	if slave.sb != 0x42 || TestBit(slave.mem.Read(InterruptFlagReg), 3) {
+		t.Errorf("idle peer took the byte, SB is %#02x", slave.sb)
+	}
+}
+
+func TestSerialDisconnect(t *testing.T) {
+	conn, peer := net.Pipe()
+	peer.Close()
+
+	s := newTestSerial(conn)
+	s.Write(SB, 0x17)
+	s.Write(SC, 0x81)
+
+	runSerial(t, func() bool { return s.link == nil }, s)
+
+	// the transfer finishes reading a disconnected cable
+	runSerial(t, func() bool { return !TestBit(s.sc, 7) }, s)
+
+	if s.sb != 0xFF {
+		t.Errorf("transfer received %#02x after the cable was unplugged, want 0xff", s.sb)
+	}
+}
+
+func TestListenLink(t *testing.T) {
+	addr := "unix:" + filepath.Join(t.TempDir(), "link")
+
+	// listening returns straight away with the cable unplugged
+	l, err := ListenLink(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	if l.Connected() {
+		t.Fatal("connected before the peer dialled")
+	}
+
+	peer, err := DialLink(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	peer.Send(linkFrame{transfer: true, data: 0x42})
+
+	select {
+	case in := <-l.in:
+		if !in.transfer || in.data != 0x42 {
+			t.Errorf("received %+v, want a transfer of 0x42", in)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("timed out")
+	}
+
+	if !l.Connected() {
+		t.Error("not connected after receiving from the peer")
+	}
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	wavHeaderSize = 44
+
+	// recorderBufferSize is how many samples the recorder keeps before writing them out
+	recorderBufferSize = 4096
+)
+
+// WAVWriter writes 16 bit stereo PCM samples to a WAV file. The sizes in the
+// header are filled in when it is closed.
+type WAVWriter struct {
+	w          io.WriteSeeker
+	sampleRate int
+	size       int
+	buf        []byte
+}
+
+func NewWAVWriter(w io.WriteSeeker, sampleRate int) (*WAVWriter, error) {
+	ww := &WAVWriter{
+		w:          w,
+		sampleRate: sampleRate,
+	}
+
+	if err := ww.writeHeader(); err != nil {
+		return nil, err
+	}
+
+	return ww, nil
+}
+
+func (w *WAVWriter) writeHeader() error {
+	var h [wavHeaderSize]byte
+	copy(h[0:], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:], uint32(36+w.size))
+	copy(h[8:], "WAVE")
+	copy(h[12:], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:], 16)
+	binary.LittleEndian.PutUint16(h[20:], 1) // PCM
+	binary.LittleEndian.PutUint16(h[22:], 2) // stereo
+	binary.LittleEndian.PutUint32(h[24:], uint32(w.sampleRate))
+	binary.LittleEndian.PutUint32(h[28:], uint32(w.sampleRate*4))
+	binary.LittleEndian.PutUint16(h[32:], 4)
+	binary.LittleEndian.PutUint16(h[34:], 16)
+	copy(h[36:], "data")
+	binary.LittleEndian.PutUint32(h[40:], uint32(w.size))
+
+	_, err := w.w.Write(h[:])
+	return err
+}
+
+// WriteSamples writes interleaved left and right samples.
+func (w *WAVWriter) WriteSamples(samples []float32) error {
+	w.buf = w.buf[:0]
+	for _, s := range samples {
+		w.buf = binary.LittleEndian.AppendUint16(w.buf, uint16(toPCM16(s)))
+	}
+
+	n, err := w.w.Write(w.buf)
+	w.size += n
+
+	return err
+}
+
+// Close fills in the sizes in the header, it does not close the underlying writer.
+func (w *WAVWriter) Close() error {
+	if _, err := w.w.Seek(0, io.SeekStart); err != nil {
+		return err
+	}
+
+	if err := w.writeHeader(); err != nil {
+		return err
+	}
+
+	_, err := w.w.Seek(0, io.SeekEnd)
+	return err
+}
+
+// toPCM16 converts a sample between -1 and 1 to a 16 bit PCM sample, louder
+// samples are clipped.
+func toPCM16(v float32) int16 {
+	v = float32(math.Max(-1, math.Min(1, float64(v))))
+
+	return int16(v * math.MaxInt16)
+}
+
+// Recorder records the APU output to a WAV file, and optionally each channel to its own file.
+type Recorder struct {
+	mix      *WAVWriter
+	channels [4]*WAVWriter
+	files    []*os.File
+
+	// samples are buffered so the files aren't written for every sample
+	mixBuf      []float32
+	channelBufs [4][]float32
+}
+
+// NewRecorder creates a WAV file at path for the mixed output. If perChannel
+// is set each channel is also written to path with -ch1 to -ch4 added to the name.
+func NewRecorder(path string, perChannel bool, sampleRate int) (*Recorder, error) {
+	r := &Recorder{}
+
+	var err error
+	r.mix, err = r.create(path, sampleRate)
+	if err != nil {
+		r.Close()
+		return nil, err
+	}
+
+	if perChannel {
+		ext := filepath.Ext(path)
+		for i := range r.channels {
+			name := fmt.Sprintf("%s-ch%d%s", strings.TrimSuffix(path, ext), i+1, ext)
+
+			r.channels[i], err = r.create(name, sampleRate)
+			if err != nil {
+				r.Close()
+				return nil, err
+			}
+		}
+	}
+
+	return r, nil
+}
+
+func (r *Recorder) create(path string, sampleRate int) (*WAVWriter, error) {
+	f, err := os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+
+	r.files = append(r.files, f)
+
+	return NewWAVWriter(f, sampleRate)
+}
+
+// Write writes a single sample of the mixed output and of each channel.
+func (r *Recorder) Write(mix [2]float32, channels [4][2]float32) error {
+	r.mixBuf = append(r.mixBuf, mix[:]...)
+	for i := range r.channelBufs {
+		if r.channels[i] != nil {
+			r.channelBufs[i] = append(r.channelBufs[i], channels[i][:]...)
+		}
+	}
+
+	if len(r.mixBuf) < recorderBufferSize {
+		return nil
+	}
+
+	return r.flush()
+}
+
+func (r *Recorder) flush() error {
+	if err := r.mix.WriteSamples(r.mixBuf); err != nil {
+		return err
+	}
+
+	r.mixBuf = r.mixBuf[:0]
+
+	for i, w := range r.channels {
+		if w == nil {
+			continue
+		}
+
+		if err := w.WriteSamples(r.channelBufs[i]); err != nil {
+			return err
+		}
+
+		r.channelBufs[i] = r.channelBufs[i][:0]
+	}
+
+	return nil
+}
+
+// Close finishes the WAV files and closes them.
+func (r *Recorder) Close() error {
+	var firstErr error
+	keep := func(err error) {
+		if firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if r.mix != nil {
+		keep(r.flush())
+	}
+
+	for _, w := range append([]*WAVWriter{r.mix}, r.channels[:]...) {
+		if w != nil {
+			keep(w.Close())
+		}
+	}
+
+	for _, f := range r.files {
+		keep(f.Close())
+	}
+
+	return firstErr
+}
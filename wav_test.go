@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/binary"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+)
+
+func TestWAVWriter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "out.wav")
+	f, err := os.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	w, err := NewWAVWriter(f, 8000)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// written in two parts to check the sizes add up
+	if err := w.WriteSamples([]float32{0, 1, -1, 0.5}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.WriteSamples([]float32{2, -2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	header, samples := readWAV(t, path)
+
+	fields := []struct {
+		name string
+		got  uint32
+		want uint32
+	}{
+		{"riff size", binary.LittleEndian.Uint32(header[4:]), 36 + 12},
+		{"format", uint32(binary.LittleEndian.Uint16(header[20:])), 1},
+		{"channels", uint32(binary.LittleEndian.Uint16(header[22:])), 2},
+		{"sample rate", binary.LittleEndian.Uint32(header[24:]), 8000},
+		{"byte rate", binary.LittleEndian.Uint32(header[28:]), 8000 * 4},
+		{"bits per sample", uint32(binary.LittleEndian.Uint16(header[34:])), 16},
+		{"data size", binary.LittleEndian.Uint32(header[40:]), 12},
+	}
+
+	for _, f := range fields {
+		if f.got != f.want {
+			t.Errorf("%s is %d, want %d", f.name, f.got, f.want)
+		}
+	}
+
+	for _, id := range []struct {
+		offset int
+		want   string
+	}{{0, "RIFF"}, {8, "WAVE"}, {12, "fmt "}, {36, "data"}} {
+		if got := string(header[id.offset : id.offset+4]); got != id.want {
+			t.Errorf("chunk id at %d is %q, want %q", id.offset, got, id.want)
+		}
+	}
+
+	// samples past full scale are clipped
+	want := []int16{0, math.MaxInt16, -math.MaxInt16, math.MaxInt16 / 2, math.MaxInt16, -math.MaxInt16}
+	if !slices.Equal(samples, want) {
+		t.Errorf("samples are %v, want %v", samples, want)
+	}
+}
+
+func TestRecorder(t *testing.T) {
+	tests := []struct {
+		name  string
+		heard Channels
+		// same is the channel whose recording the mix must match
+		same int
+	}{
+		{name: "mute channel 2", heard: AllChannels &^ 0x2, same: 0},
+		{name: "solo channel 2", heard: 0x2, same: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "out.wav")
+
+			a := NewAPU(8000)
+			a.SetHeard(tt.heard)
+			if err := a.StartRecording(path, true); err != nil {
+				t.Fatal(err)
+			}
+
+			// play channels 1 and 2 at different pitches, 3 and 4 stay silent
+			a.Write(NR52, 0x80)
+			a.Write(NR50, 0x77)
+			a.Write(NR51, 0xFF)
+			a.Write(NR11, 0x80)
+			a.Write(NR12, 0xF0)
+			a.Write(NR13, 0x00)
+			a.Write(NR14, 0x87)
+			a.Write(NR21, 0x80)
+			a.Write(NR22, 0xF0)
+			a.Write(NR23, 0x00)
+			a.Write(NR24, 0x86)
+
+			a.Update(ClockSpeed / 16)
+
+			if err := a.StopRecording(); err != nil {
+				t.Fatal(err)
+			}
+
+			_, mix := readWAV(t, path)
+			if want := 2 * 8000 / 16; len(mix) != want {
+				t.Fatalf("mix has %d samples, want %d", len(mix), want)
+			}
+
+			var channels [4][]int16
+			for i := range channels {
+				_, channels[i] = readWAV(t, filepath.Join(filepath.Dir(path), "out-ch"+string(rune('1'+i))+".wav"))
+				if len(channels[i]) != len(mix) {
+					t.Errorf("channel %d has %d samples, want %d", i+1, len(channels[i]), len(mix))
+				}
+			}
+
+			// muted channels are still recorded on their own
+			for i := 0; i < 2; i++ {
+				if silent(channels[i]) {
+					t.Errorf("channel %d recording is silent", i+1)
+				}
+			}
+
+			for i := 2; i < 4; i++ {
+				if !silent(channels[i]) {
+					t.Errorf("channel %d recording isn't silent", i+1)
+				}
+			}
+
+			if !slices.Equal(mix, channels[tt.same]) {
+				t.Errorf("mix doesn't match channel %d", tt.same+1)
+			}
+		})
+	}
+}
+
+// readWAV returns the header and samples of a WAV file, checking the data
+// size in the header matches the file.
+func readWAV(t *testing.T, path string) ([]byte, []int16) {
+	t.Helper()
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(data) < wavHeaderSize {
+		t.Fatalf("%s is only %d bytes", path, len(data))
+	}
+
+	header, body := data[:wavHeaderSize], data[wavHeaderSize:]
+	if size := binary.LittleEndian.Uint32(header[40:]); int(size) != len(body) {
+		t.Errorf("%s data size is %d but has %d bytes", path, size, len(body))
+	}
+
+	samples := make([]int16, len(body)/2)
+	for i := range samples {
+		samples[i] = int16(binary.LittleEndian.Uint16(body[i*2:]))
+	}
+
+	return header, samples
+}
+
+func silent(samples []int16) bool {
+	for _, s := range samples {
+		if s != 0 {
+			return false
+		}
+	}
+
+	return true
+}